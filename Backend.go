@@ -0,0 +1,58 @@
+package synk
+
+// MongoBackend stores objects in the Node's mongodb collection, and publishes
+// messages to clients via the Node's redis pool. It hands out *MongoSynk
+// Mutators and Loaders. This is the default Backend.
+type MongoBackend struct{}
+
+// NewMutator returns a *MongoSynk with a cloned mongo session.
+//
+// Panic if the node was created without a mongodb connection.
+func (MongoBackend) NewMutator(node *Node) Mutator {
+	return newMongoSynk(node)
+}
+
+// NewLoader returns a *MongoSynk with a cloned mongo session.
+//
+// Panic if the node was created without a mongodb connection.
+func (MongoBackend) NewLoader(node *Node) Loader {
+	return newMongoSynk(node)
+}
+
+func newMongoSynk(node *Node) *MongoSynk {
+	if node.mongoSession == nil {
+		panic("synk.MongoBackend requires a Node with a mongodb connection")
+	}
+	return &MongoSynk{
+		Creator:   node.NewContainer,
+		Coll:      node.mongoSession.Clone().DB(node.config.MongoDBName).C(node.config.MongoCollection),
+		RedisPool: node.redisPool,
+		Logger:    node.logger,
+		Metrics:   node.metrics,
+	}
+}
+
+// RedisBackend stores objects in redis. It hands out *RedisSynk Mutators and
+// Loaders that share the Node's redis pool. A Node that uses a RedisBackend
+// does not need a mongodb connection.
+type RedisBackend struct{}
+
+// NewMutator returns a *RedisSynk that uses the node's redis pool.
+func (RedisBackend) NewMutator(node *Node) Mutator {
+	return &RedisSynk{
+		Pool:        node.redisPool,
+		Constructor: node.NewContainer,
+		Logger:      node.logger,
+		Metrics:     node.metrics,
+	}
+}
+
+// NewLoader returns a *RedisSynk that uses the node's redis pool.
+func (RedisBackend) NewLoader(node *Node) Loader {
+	return &RedisSynk{
+		Pool:        node.redisPool,
+		Constructor: node.NewContainer,
+		Logger:      node.logger,
+		Metrics:     node.metrics,
+	}
+}
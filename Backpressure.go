@@ -0,0 +1,314 @@
+package synk
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// The reason sent in the close frame when a slow client is disconnected.
+	slowClientReason = "slow client"
+
+	// When coalescing, the maximum number of messages waiting for room in a
+	// client's buffer. If a client falls further behind, it is disconnected.
+	coalesceLimit = 4096
+)
+
+type backpressureKind int
+
+const (
+	backpressureBlock backpressureKind = iota
+	backpressureDisconnect
+	backpressureResync
+	backpressureCoalesce
+)
+
+// A BackpressurePolicy decides what happens when a message is published to a
+// client whose outgoing buffer is full, because the browser is not reading
+// from its websocket fast enough. Messages are delivered to clients by the
+// Broker, so while a delivery is blocked, the Broker cannot deliver messages
+// to any other client.
+//
+// Create a BackpressurePolicy with BlockSlowClients, DisconnectSlowClients,
+// ResyncSlowClients or CoalesceSlowClients, and pass it to
+// Node.SetBackpressurePolicy.
+type BackpressurePolicy struct {
+	kind    backpressureKind
+	timeout time.Duration
+}
+
+// BlockSlowClients returns the default policy. The Broker waits until there
+// is room in the client's buffer, however long that takes.
+func BlockSlowClients() BackpressurePolicy {
+	return BackpressurePolicy{kind: backpressureBlock}
+}
+
+// DisconnectSlowClients returns a policy that waits up to timeout for room in
+// the client's buffer. If there is still no room, the message is dropped, and
+// the client is disconnected with the CloseTryAgainLater code.
+func DisconnectSlowClients(timeout time.Duration) BackpressurePolicy {
+	return BackpressurePolicy{kind: backpressureDisconnect, timeout: timeout}
+}
+
+// ResyncSlowClients returns a policy that never waits. If the client's buffer
+// is full, the message is dropped, along with any later messages on the same
+// subscription key. Once there is room in the buffer, the client is sent a
+// "resync" message listing the affected keys, and should resubscribe to them.
+func ResyncSlowClients() BackpressurePolicy {
+	return BackpressurePolicy{kind: backpressureResync}
+}
+
+// CoalesceSlowClients returns a policy that never waits. If the client's
+// buffer is full, messages are queued until there is room. While a mod
+// message is queued, later mod messages for the same object are merged into
+// it, so the browser receives one mod with the combined diff. A client that
+// falls too far behind is disconnected with the CloseTryAgainLater code.
+func CoalesceSlowClients() BackpressurePolicy {
+	return BackpressurePolicy{kind: backpressureCoalesce}
+}
+
+// SetBackpressurePolicy sets the BackpressurePolicy for clients that connect
+// after the call. The default is BlockSlowClients.
+func (node *Node) SetBackpressurePolicy(policy BackpressurePolicy) {
+	node.backpressure = policy
+}
+
+// pendingMsg is a message waiting for room in a client's buffer. If mod is
+// not nil, the message is a mod message that later mods may be merged into.
+type pendingMsg struct {
+	bytes []byte
+	mod   *pendingMod
+}
+
+type pendingMod struct {
+	ID      string                     `json:"id"`
+	SKey    string                     `json:"sKey"`
+	NSKey   string                     `json:"nsKey"`
+	Version uint                       `json:"v"`
+	Diff    map[string]json.RawMessage `json:"diff"`
+}
+
+func (pm *pendingMsg) marshal() ([]byte, error) {
+	if pm.mod == nil {
+		return pm.bytes, nil
+	}
+	return json.Marshal(modMsg{
+		Diff:    pm.mod.Diff,
+		ID:      pm.mod.ID,
+		Version: pm.mod.Version,
+		SKey:    pm.mod.SKey,
+	})
+}
+
+// send bytes published on subKey to the toWebSocket channel, according to the
+// client's BackpressurePolicy. Safe for concurrent calls, but must not be
+// called from the main loop.
+func (client *synkClient) send(subKey string, bytes []byte) {
+	switch client.backpressure.kind {
+	case backpressureResync:
+		client.sendOrResync(subKey, bytes)
+	case backpressureCoalesce:
+		client.sendOrCoalesce(bytes)
+	default:
+		client.sendOrWait(bytes)
+	}
+}
+
+func (client *synkClient) sendOrWait(bytes []byte) {
+	select {
+	case client.toWebSocket <- bytes:
+		return
+	default:
+		client.Node.stats.bufferFull.Inc()
+	}
+
+	if client.backpressure.kind == backpressureBlock {
+		select {
+		case client.toWebSocket <- bytes:
+		case <-client.closed:
+		}
+		return
+	}
+
+	client.bpMutex.Lock()
+	slow := client.slow
+	client.bpMutex.Unlock()
+	if slow {
+		// The client is already being disconnected
+		client.Node.stats.dropped.Inc()
+		return
+	}
+
+	timer := time.NewTimer(client.backpressure.timeout)
+	defer timer.Stop()
+
+	select {
+	case client.toWebSocket <- bytes:
+	case <-client.closed:
+	case <-timer.C:
+		client.Node.stats.dropped.Inc()
+		client.bpMutex.Lock()
+		client.disconnectSlow()
+		client.bpMutex.Unlock()
+	}
+}
+
+func (client *synkClient) sendOrResync(subKey string, bytes []byte) {
+	client.bpMutex.Lock()
+	defer client.bpMutex.Unlock()
+
+	client.flushResync()
+
+	if client.resyncKeys[subKey] {
+		// The browser will resync this key anyway
+		client.Node.stats.dropped.Inc()
+		return
+	}
+
+	select {
+	case client.toWebSocket <- bytes:
+	default:
+		client.Node.stats.bufferFull.Inc()
+		client.Node.stats.dropped.Inc()
+		if isReservedKey(subKey) {
+			// The browser cannot resync direct messages
+			return
+		}
+		client.Node.stats.slowResyncs.Inc()
+		client.resyncKeys[subKey] = true
+	}
+}
+
+// flushResync tries to send a resync message for the keys that had messages
+// dropped. Must be called while holding bpMutex. Never blocks.
+func (client *synkClient) flushResync() {
+	if len(client.resyncKeys) == 0 {
+		return
+	}
+
+	subKeys := make([]string, 0, len(client.resyncKeys))
+	for subKey := range client.resyncKeys {
+		subKeys = append(subKeys, subKey)
+	}
+	sort.Strings(subKeys)
+
+	bytes, err := json.Marshal(resyncMsg{SKeys: subKeys})
+	if err != nil {
+		client.logError("Client failed to marshal resync message", "err", err)
+		return
+	}
+
+	select {
+	case client.toWebSocket <- bytes:
+		client.resyncKeys = make(map[string]bool)
+	default:
+	}
+}
+
+func (client *synkClient) sendOrCoalesce(bytes []byte) {
+	client.bpMutex.Lock()
+	defer client.bpMutex.Unlock()
+
+	if client.slow {
+		client.Node.stats.dropped.Inc()
+		return
+	}
+
+	// Messages may only skip the queue when it is empty. Otherwise they
+	// would arrive out of order.
+	if len(client.overflow) == 0 {
+		select {
+		case client.toWebSocket <- bytes:
+			return
+		default:
+			client.Node.stats.bufferFull.Inc()
+		}
+	}
+
+	var msg struct {
+		Method string `json:"method"`
+		pendingMod
+	}
+	if err := json.Unmarshal(bytes, &msg); err != nil {
+		client.logError("Client failed to parse message while coalescing", "err", err)
+	}
+
+	if msg.Method == "mod" && msg.NSKey == "" && msg.Diff != nil {
+		if pending, ok := client.pendingMods[msg.ID]; ok && pending.mod.SKey == msg.SKey {
+			for field, value := range msg.Diff {
+				pending.mod.Diff[field] = value
+			}
+			pending.mod.Version = msg.Version
+			client.Node.stats.slowCoalesced.Inc()
+			return
+		}
+	}
+
+	if len(client.overflow) >= coalesceLimit {
+		client.Node.stats.dropped.Inc()
+		client.disconnectSlow()
+		return
+	}
+
+	pending := &pendingMsg{bytes: bytes}
+	if msg.Method == "mod" && msg.NSKey == "" && msg.Diff != nil {
+		mod := msg.pendingMod
+		pending.mod = &mod
+		client.pendingMods[msg.ID] = pending
+	} else if msg.ID != "" {
+		// Later mods must not be merged into a message before this one
+		delete(client.pendingMods, msg.ID)
+	}
+	client.overflow = append(client.overflow, pending)
+}
+
+// relieveBackpressure moves messages that were held back by the
+// BackpressurePolicy into the toWebSocket channel, if there is room. The main
+// loop calls it each time it takes a message from the channel. Never blocks.
+func (client *synkClient) relieveBackpressure() {
+	switch client.backpressure.kind {
+	case backpressureResync:
+		client.bpMutex.Lock()
+		client.flushResync()
+		client.bpMutex.Unlock()
+	case backpressureCoalesce:
+		client.bpMutex.Lock()
+		defer client.bpMutex.Unlock()
+		for len(client.overflow) > 0 {
+			pending := client.overflow[0]
+			bytes, err := pending.marshal()
+			if err != nil {
+				client.logError("Client failed to marshal coalesced message", "err", err)
+			} else {
+				select {
+				case client.toWebSocket <- bytes:
+				default:
+					return
+				}
+			}
+			if pending.mod != nil && client.pendingMods[pending.mod.ID] == pending {
+				delete(client.pendingMods, pending.mod.ID)
+			}
+			client.overflow[0] = nil
+			client.overflow = client.overflow[1:]
+		}
+		client.overflow = nil
+	}
+}
+
+// disconnectSlow closes the client because it cannot keep up with the
+// messages published to it. Must be called while holding bpMutex.
+func (client *synkClient) disconnectSlow() {
+	if client.slow {
+		return
+	}
+	client.slow = true
+	client.overflow = nil
+	client.pendingMods = nil
+	client.Node.stats.slowDisconnects.Inc()
+	client.logInfo("Client disconnected because it is too slow")
+	go client.closeWithReason(websocket.CloseTryAgainLater, slowClientReason)
+}
@@ -0,0 +1,39 @@
+package synk
+
+import "sync/atomic"
+
+// Every node listens for Broadcast messages on this channel.
+const broadcastChannel = reservedPrefix + "broadcast"
+
+// BroadcastLocal sends msg to every client connected to this node, for
+// example to announce maintenance. If msg is a []byte, it is sent directly.
+// Otherwise it is marshaled to JSON. Either way, it must be a JSON object.
+//
+// Broadcasts never wait for slow clients. A client whose buffer is full misses
+// the message, regardless of the node's BackpressurePolicy. Missed broadcasts
+// are counted in the synk_broadcast_dropped_total metric, and logged with the
+// number of broadcasts the client has missed.
+func (node *Node) BroadcastLocal(msg interface{}) error {
+	bytes, err := marshalMessage(msg)
+	if err != nil {
+		return err
+	}
+	node.stats.broadcasts.Inc()
+	node.clients.send(bytes)
+	return nil
+}
+
+// Broadcast sends msg to every client connected to any node that shares this
+// node's redis server. It is published to every node, which passes it to
+// BroadcastLocal, so Broadcast returns before the message is sent.
+func (node *Node) Broadcast(msg interface{}) error {
+	return node.publish("Node.Broadcast", broadcastChannel, msg)
+}
+
+// dropBroadcast records that the client missed a broadcast. Safe for
+// concurrent calls.
+func (client *synkClient) dropBroadcast() {
+	client.Node.stats.broadcastDropped.Inc()
+	dropped := atomic.AddUint64(&client.broadcastDrops, 1)
+	client.logInfo("Client missed a broadcast because its buffer is full", "dropped", dropped)
+}
@@ -0,0 +1,455 @@
+package synk
+
+import (
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// Ping the redis subscription connection at this interval. If no reply
+	// (or other message) arrives within brokerReadTimeout, the connection is
+	// considered broken.
+	brokerPingInterval = 30 * time.Second
+	brokerReadTimeout  = 2 * brokerPingInterval
+
+	// Defaults for Config.RedisReconnectMin and Config.RedisReconnectMax
+	defaultReconnectMin = 100 * time.Millisecond
+	defaultReconnectMax = 10 * time.Second
+)
+
+// A Resyncer is an Agent that wants to know when messages on its channels may
+// have been lost. synkClient is a Resyncer.
+type Resyncer interface {
+	Resync(channels []string)
+}
+
+// RedisBroker delivers messages published in redis to subscribed Agents. It
+// uses a single redis connection for all of its subscriptions.
+//
+// If the subscription connection breaks (for example, because redis
+// restarted), RedisBroker redials with exponential backoff, and re-issues
+// SUBSCRIBE for every channel that any Agent still holds. Messages published
+// while the connection was down are lost, so once the connection is
+// restored, every Agent that implements Resyncer is told which of its
+// channels to resync.
+type RedisBroker struct {
+	dial         func() (redis.Conn, error)
+	reconnectMin time.Duration
+	reconnectMax time.Duration
+
+	// mutex guards everything below. It also serializes writes to conn.
+	mutex     sync.Mutex
+	logger    Logger
+	conn      redis.PubSubConn
+	connected bool
+	closed    bool
+	channels  map[string]map[Agent]bool
+	agents    map[Agent]map[string]bool
+	done      chan struct{}
+}
+
+// NewRedisBroker dials a subscription connection using cfg, and starts the
+// goroutine that receives messages from redis. Return an error if the initial
+// connection cannot be made.
+func NewRedisBroker(cfg Config) (*RedisBroker, error) {
+	rb := &RedisBroker{
+		dial:         cfg.DialRedis,
+		reconnectMin: cfg.RedisReconnectMin,
+		reconnectMax: cfg.RedisReconnectMax,
+		logger:       loggerOrDefault(cfg.Logger),
+		channels:     make(map[string]map[Agent]bool),
+		agents:       make(map[Agent]map[string]bool),
+		done:         make(chan struct{}),
+	}
+	if rb.reconnectMin <= 0 {
+		rb.reconnectMin = defaultReconnectMin
+	}
+	if rb.reconnectMax < rb.reconnectMin {
+		rb.reconnectMax = defaultReconnectMax
+	}
+
+	conn, err := rb.dial()
+	if err != nil {
+		return nil, err
+	}
+	rb.conn = redis.PubSubConn{Conn: conn}
+	rb.connected = true
+
+	go rb.run()
+	go rb.ping()
+	return rb, nil
+}
+
+// Update subscribes agent to the add channels, and unsubscribes it from the
+// remove channels. Redis SUBSCRIBE and UNSUBSCRIBE commands are only sent for
+// channels that gain their first agent or lose their last agent.
+func (rb *RedisBroker) Update(agent Agent, add []string, remove []string) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	subs, ok := rb.agents[agent]
+	if !ok {
+		subs = make(map[string]bool)
+		rb.agents[agent] = subs
+	}
+
+	var unsubscribe, subscribe []interface{}
+
+	for _, channel := range remove {
+		delete(subs, channel)
+		if agents, ok := rb.channels[channel]; ok {
+			delete(agents, agent)
+			if len(agents) == 0 {
+				delete(rb.channels, channel)
+				unsubscribe = append(unsubscribe, channel)
+			}
+		}
+	}
+
+	for _, channel := range add {
+		subs[channel] = true
+		agents, ok := rb.channels[channel]
+		if !ok {
+			agents = make(map[Agent]bool)
+			rb.channels[channel] = agents
+			subscribe = append(subscribe, channel)
+		}
+		agents[agent] = true
+	}
+
+	// If the connection is down, the errors are ignored. The run goroutine
+	// will subscribe to all the channels once it reconnects.
+	if rb.connected && len(unsubscribe) > 0 {
+		rb.conn.Unsubscribe(unsubscribe...)
+	}
+	if rb.connected && len(subscribe) > 0 {
+		rb.conn.Subscribe(subscribe...)
+	}
+}
+
+// RemoveAgent unsubscribes agent from all channels.
+func (rb *RedisBroker) RemoveAgent(agent Agent) {
+	rb.mutex.Lock()
+	subs := make([]string, 0, len(rb.agents[agent]))
+	for channel := range rb.agents[agent] {
+		subs = append(subs, channel)
+	}
+	rb.mutex.Unlock()
+
+	rb.Update(agent, nil, subs)
+
+	rb.mutex.Lock()
+	delete(rb.agents, agent)
+	rb.mutex.Unlock()
+}
+
+// SetLogger replaces the Logger used to report connection problems.
+func (rb *RedisBroker) SetLogger(logger Logger) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	rb.logger = loggerOrDefault(logger)
+}
+
+// Connected reports if the subscription connection is currently up.
+func (rb *RedisBroker) Connected() bool {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	return rb.connected
+}
+
+// Close the subscription connection, and stop receiving messages.
+func (rb *RedisBroker) Close() error {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	if rb.closed {
+		return nil
+	}
+	rb.closed = true
+	close(rb.done)
+	return rb.conn.Close()
+}
+
+// run receives messages from redis, and forwards them to agents. When the
+// connection breaks, reconnect.
+func (rb *RedisBroker) run() {
+	for {
+		rb.mutex.Lock()
+		conn := rb.conn
+		rb.mutex.Unlock()
+
+		switch v := conn.ReceiveWithTimeout(brokerReadTimeout).(type) {
+		case redis.Message:
+			rb.mutex.Lock()
+			agents := make([]Agent, 0, len(rb.channels[v.Channel]))
+			for agent := range rb.channels[v.Channel] {
+				agents = append(agents, agent)
+			}
+			rb.mutex.Unlock()
+
+			// Receive may block, so we must not hold the lock here.
+			for _, agent := range agents {
+				agent.Receive(v.Channel, v.Data)
+			}
+		case error:
+			if !rb.reconnect(v) {
+				return
+			}
+		}
+	}
+}
+
+// ping the subscription connection periodically, so that run notices a
+// half-open connection.
+func (rb *RedisBroker) ping() {
+	ticker := time.NewTicker(brokerPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rb.done:
+			return
+		case <-ticker.C:
+			rb.mutex.Lock()
+			if rb.connected {
+				rb.conn.Ping("")
+			}
+			rb.mutex.Unlock()
+		}
+	}
+}
+
+// reconnect replaces a broken subscription connection. It blocks until the
+// connection is restored, or the broker is closed. Return false if the broker
+// was closed.
+func (rb *RedisBroker) reconnect(cause error) bool {
+	rb.mutex.Lock()
+	if rb.closed {
+		rb.mutex.Unlock()
+		return false
+	}
+	logger := rb.logger
+	rb.connected = false
+	rb.conn.Close()
+	rb.mutex.Unlock()
+
+	logger.Error("RedisBroker subscription connection lost", "err", cause)
+
+	delay := rb.reconnectMin
+	for {
+		select {
+		case <-rb.done:
+			return false
+		case <-time.After(delay):
+		}
+
+		conn, err := rb.dial()
+		if err == nil {
+			if rb.restore(conn) {
+				return true
+			}
+			return false
+		}
+
+		delay *= 2
+		if delay > rb.reconnectMax {
+			delay = rb.reconnectMax
+		}
+		logger.Error("RedisBroker failed to reconnect", "err", err, "retryIn", delay)
+	}
+}
+
+// restore installs a newly dialed connection, subscribes to every channel
+// that has agents, and tells those agents to resync. Return false if the
+// broker was closed while we were dialing.
+func (rb *RedisBroker) restore(conn redis.Conn) bool {
+	rb.mutex.Lock()
+	if rb.closed {
+		rb.mutex.Unlock()
+		conn.Close()
+		return false
+	}
+
+	rb.conn = redis.PubSubConn{Conn: conn}
+	rb.connected = true
+
+	channels := make([]interface{}, 0, len(rb.channels))
+	for channel := range rb.channels {
+		channels = append(channels, channel)
+	}
+	if len(channels) > 0 {
+		rb.conn.Subscribe(channels...)
+	}
+
+	resync := make(map[Resyncer][]string)
+	for agent, subs := range rb.agents {
+		if resyncer, ok := agent.(Resyncer); ok && len(subs) > 0 {
+			for channel := range subs {
+				resync[resyncer] = append(resync[resyncer], channel)
+			}
+		}
+	}
+	logger := rb.logger
+	rb.mutex.Unlock()
+
+	logger.Info("RedisBroker reconnected", "channels", len(channels))
+
+	for resyncer, subs := range resync {
+		resyncer.Resync(subs)
+	}
+	return true
+}
+
+// MemoryBroker is an in-process Broker. Messages passed to Publish are
+// delivered to every Agent subscribed to the channel, in the order they were
+// published, by a single dispatch goroutine. Like redis, Publish never waits
+// for the Agents to receive the message.
+//
+// A MemoryBroker only delivers messages within one process. Use it for tests,
+// or for single process servers that do not need redis.
+type MemoryBroker struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	channels map[string]map[Agent]bool
+	agents   map[Agent]map[string]bool
+	queue    []brokerMessage
+	closed   bool
+}
+
+type brokerMessage struct {
+	channel string
+	data    []byte
+}
+
+// NewMemoryBroker creates a MemoryBroker and starts its dispatch goroutine.
+// Call Close to stop the goroutine.
+func NewMemoryBroker() *MemoryBroker {
+	mb := &MemoryBroker{
+		channels: make(map[string]map[Agent]bool),
+		agents:   make(map[Agent]map[string]bool),
+	}
+	mb.cond = sync.NewCond(&mb.mutex)
+	go mb.run()
+	return mb
+}
+
+// Update subscribes agent to the add channels, and unsubscribes it from the
+// remove channels.
+func (mb *MemoryBroker) Update(agent Agent, add []string, remove []string) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	subs, ok := mb.agents[agent]
+	if !ok {
+		subs = make(map[string]bool)
+		mb.agents[agent] = subs
+	}
+
+	for _, channel := range remove {
+		delete(subs, channel)
+		if agents, ok := mb.channels[channel]; ok {
+			delete(agents, agent)
+			if len(agents) == 0 {
+				delete(mb.channels, channel)
+			}
+		}
+	}
+
+	for _, channel := range add {
+		subs[channel] = true
+		agents, ok := mb.channels[channel]
+		if !ok {
+			agents = make(map[Agent]bool)
+			mb.channels[channel] = agents
+		}
+		agents[agent] = true
+	}
+}
+
+// RemoveAgent unsubscribes agent from all channels.
+func (mb *MemoryBroker) RemoveAgent(agent Agent) {
+	mb.mutex.Lock()
+	subs := make([]string, 0, len(mb.agents[agent]))
+	for channel := range mb.agents[agent] {
+		subs = append(subs, channel)
+	}
+	mb.mutex.Unlock()
+
+	mb.Update(agent, nil, subs)
+
+	mb.mutex.Lock()
+	delete(mb.agents, agent)
+	mb.mutex.Unlock()
+}
+
+// Publish a message. If the message is a []byte, publish it directly.
+// Otherwise Marshal it to JSON.
+func (mb *MemoryBroker) Publish(channel string, msg interface{}) error {
+	bytes, err := marshalMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	if !mb.closed {
+		mb.queue = append(mb.queue, brokerMessage{channel: channel, data: bytes})
+		mb.cond.Signal()
+	}
+	return nil
+}
+
+// subscribers returns the number of agents subscribed to channel
+func (mb *MemoryBroker) subscribers(channel string) int {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	if mb.closed {
+		return 0
+	}
+	return len(mb.channels[channel])
+}
+
+// Connected reports if the broker is delivering messages. It is only false
+// after Close is called.
+func (mb *MemoryBroker) Connected() bool {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	return !mb.closed
+}
+
+// Close stops the dispatch goroutine. Messages that have not yet been
+// delivered are discarded.
+func (mb *MemoryBroker) Close() error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	mb.closed = true
+	mb.queue = nil
+	mb.cond.Broadcast()
+	return nil
+}
+
+// run delivers queued messages until the broker is closed.
+func (mb *MemoryBroker) run() {
+	for {
+		mb.mutex.Lock()
+		for len(mb.queue) == 0 && !mb.closed {
+			mb.cond.Wait()
+		}
+		if mb.closed {
+			mb.mutex.Unlock()
+			return
+		}
+		msg := mb.queue[0]
+		mb.queue = mb.queue[1:]
+		agents := make([]Agent, 0, len(mb.channels[msg.channel]))
+		for agent := range mb.channels[msg.channel] {
+			agents = append(agents, agent)
+		}
+		mb.mutex.Unlock()
+
+		// Receive may block, so we must not hold the lock here.
+		for _, agent := range agents {
+			agent.Receive(msg.channel, msg.data)
+		}
+	}
+}
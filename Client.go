@@ -3,7 +3,7 @@ package synk
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -25,27 +25,85 @@ const (
 
 	// Size of the buffer for outgoing messages to clients
 	clientBufferLength = 64
+
+	// The reason sent in the close frame when the node shuts down. Along with
+	// the CloseServiceRestart code, this tells the browser to reconnect.
+	shutdownReason = "reconnect"
 )
 
 // synkClient represents a connected client in a browser. Includes the client's
 // websocket and redis connections.
 // The client does not know which pools it is a part of.
 type synkClient struct {
+	// broadcastDrops counts missed broadcasts. It is first, so that it is
+	// 64-bit aligned for atomic operations.
+	broadcastDrops uint64
+
 	Node          *Node
 	Loader        Loader
 	custom        CustomClient
 	wsConn        *websocket.Conn
 	fromWebSocket chan interface{}
-	toWebSocket   chan []byte // safe to send messages here concurrently
+	toWebSocket   chan []byte // never closed. Blocking sends must also select on closed
 	id            ID
+	principal     interface{}
+	compress      int // compress messages at least this long. -1 disables
+	codec         Codec
 	subscriptions map[string]bool
 	closeOnce     sync.Once
+	reasonOnce    sync.Once  // guards closeWithReason
+	reasonMutex   sync.Mutex // guards reason
+	reason        string     // why the client disconnected
 	waitGroup     sync.WaitGroup
+	closed        chan struct{}  // closed by Close
+	rpcs          sync.WaitGroup // RPC handlers that may still reply
+	rpcMutex      sync.Mutex     // guards closing closed, and adding to rpcs
+
+	// The BackpressurePolicy, and the state it needs, guarded by bpMutex.
+	// See Backpressure.go
+	backpressure BackpressurePolicy
+	bpMutex      sync.Mutex
+	slow         bool                   // the client is being disconnected
+	resyncKeys   map[string]bool        // keys with dropped messages
+	overflow     []*pendingMsg          // messages waiting for room
+	pendingMods  map[string]*pendingMsg // object id -> mergeable mod in overflow
+
+	// When session resume is enabled, the session is the Agent subscribed
+	// with the broker. hello is the session message, and replay holds the
+	// messages from a resumed session. The main loop writes both before
+	// anything else, and then passes the restored subscription keys to
+	// OnSubscribe. See Session.go
+	session  *session
+	hello    []byte
+	replay   [][]byte
+	restored []string
+
+	// Token buckets for the node's ClientLimits. Only used by
+	// startReadingFromWebSocket. See Limits.go
+	rateBucket    *tokenBucket
+	methodBuckets map[string]*tokenBucket
 }
 
-func newClient(node *Node, wsConn *websocket.Conn) (*synkClient, error) {
+// clientOptions are the per connection settings chosen by a Handler.
+type clientOptions struct {
+	// principal is the value returned by the Authenticator
+	principal interface{}
+
+	// compressThreshold is the minimum size of messages that are sent
+	// compressed, if compression was negotiated. -1 disables compression.
+	compressThreshold int
+
+	// codec converts messages to and from the wire format
+	codec Codec
+
+	// resumeToken and received are the browser's request to resume a
+	// session. See Node.EnableSessionResume
+	resumeToken string
+	received    uint64
+}
+
+func newClient(node *Node, wsConn *websocket.Conn, constructor ClientConstructor, opts clientOptions) (*synkClient, error) {
 	var client *synkClient
-	log.Println("Creating New Client...")
 
 	client = &synkClient{
 		Node:          node,
@@ -54,32 +112,106 @@ func newClient(node *Node, wsConn *websocket.Conn) (*synkClient, error) {
 		fromWebSocket: make(chan interface{}, clientBufferLength),
 		toWebSocket:   make(chan []byte, clientBufferLength),
 		id:            NewID(),
+		principal:     opts.principal,
+		compress:      opts.compressThreshold,
+		codec:         opts.codec,
 		subscriptions: make(map[string]bool),
+		closed:        make(chan struct{}),
+		backpressure:  node.backpressure,
+		resyncKeys:    make(map[string]bool),
+		pendingMods:   make(map[string]*pendingMsg),
+		methodBuckets: make(map[string]*tokenBucket),
 	}
 	client.waitGroup.Add(1)
 
+	if node.limits.MaxMessageSize > 0 {
+		wsConn.SetReadLimit(node.limits.MaxMessageSize)
+	}
+
 	//
 	go func() {
 		client.waitGroup.Wait()
-		fmt.Println("Graceful shutdown:", client.ID())
+		client.logInfo("Client shut down gracefully")
 		client.Loader.Close()
 	}()
 
+	// The custom client must exist before the main loop starts, because the
+	// main loop passes messages to it. A resumed session's subscriptions are
+	// checked by its SubscriptionAuthorizer.
+	client.custom = constructor(client)
+
+	if node.resumeGrace > 0 {
+		client.startSession(opts.resumeToken, opts.received)
+	}
+
+	client.Node.broker.Update(client.agent(), []string{clientChannel(client.ID())}, nil)
+
 	go client.startMainLoop()
 	go client.startReadingFromWebSocket()
 
-	client.custom = node.NewClient(client)
 	client.custom.OnConnect(client)
 
-	log.Println("synk.newClient created:", client.id)
+	client.logInfo("Client created")
 	return client, nil
 }
 
+// startSession resumes the session identified by token, or starts a new
+// session. Must be called before the client's goroutines start.
+func (client *synkClient) startSession(token string, received uint64) {
+	resumed := false
+	if token != "" {
+		if s := client.Node.session(token); s != nil {
+			var rejected []string
+			client.replay, rejected, resumed = s.resume(client, received)
+			if resumed {
+				client.session = s
+				if len(rejected) > 0 {
+					client.Node.broker.Update(s, nil, rejected)
+				}
+				for subKey := range client.subscriptions {
+					client.restored = append(client.restored, subKey)
+				}
+				sort.Strings(client.restored)
+				client.Node.stats.subscriptions.Add(int64(len(client.subscriptions)))
+				client.Node.stats.sessionsResumed.Inc()
+				client.logInfo("Client resumed session", "replayed", len(client.replay))
+			}
+		}
+		if !resumed {
+			client.Node.stats.resumeFailures.Inc()
+		}
+	}
+	if !resumed {
+		client.session = client.Node.newSession(client)
+	}
+
+	bytes, err := json.Marshal(sessionMsg{Token: client.session.token, Resumed: resumed})
+	if err != nil {
+		client.logError("Client failed to marshal session message", "err", err)
+		return
+	}
+	client.hello = bytes
+}
+
+// agent returns the Agent that receives the client's messages from the Broker
+func (client *synkClient) agent() Agent {
+	if client.session != nil {
+		return client.session
+	}
+	return client
+}
+
 // ID returns the client's id as a string
 func (client *synkClient) ID() string {
 	return client.id.String()
 }
 
+// Principal returns the value returned by the Authenticator when the client
+// connected, or nil.
+func (client *synkClient) Principal() interface{} {
+	return client.principal
+}
+
 // Publish a message to the synk system
 func (client *synkClient) Publish(key string, msg interface{}) error {
 	return client.Loader.Publish(key, msg)
@@ -87,24 +219,35 @@ func (client *synkClient) Publish(key string, msg interface{}) error {
 
 // Receive handles byteSlices from redis.
 //
-// It will be called by pubsub.RedisAgents when we receive a value from redis.
+// It will be called by the node's Broker when we receive a value from redis.
 //
-// Input: client.Node.redisAgents
+// Input: client.Node.broker
 // Output: client.toWebSocket channel
 //
 // While this function is safe for concurrent calls, we may still want to be
 // careful with where it gets called from, because the order synk messages
 // arrive in is important.
 func (client *synkClient) Receive(key string, bytes []byte) (err error) {
+	client.Node.stats.received.Inc()
+
+	if msg, ok := client.filter(client.subscriptions, key, bytes); ok {
+		client.send(key, msg)
+	}
+	return
+}
+
+// filter decides if a message received on the key channel should be sent to
+// a client with the supplied subscriptions. Return the message with any header
+// removed, and true if it should be sent.
+func (client *synkClient) filter(subscriptions map[string]bool, key string, bytes []byte) ([]byte, bool) {
 	s := string(bytes)
 	split := strings.Index(s, "{")
 	if split == 0 {
-		client.toWebSocket <- bytes
-		return
+		return bytes, true
 	}
 	if split == -1 {
-		fmt.Printf("synk.Client.Receive: Error with bytes from redis: %s\n", bytes)
-		return
+		client.logError("Client.Receive got invalid bytes from redis", "subKey", key, "bytes", string(bytes))
+		return nil, false
 	}
 
 	// This json was sent with a header. This is a proprietary extension that lets
@@ -118,15 +261,45 @@ func (client *synkClient) Receive(key string, bytes []byte) (err error) {
 		// This object is moving into the space 'from' another chunk. If we are
 		// already subscribed to that chunk then we do not need to send the message.
 		fromWhere := header[5:]
-		if _, ok := client.subscriptions[fromWhere]; !ok {
-			// We are not subscribed to the chunk this object is entering from.
-			client.toWebSocket <- bytes
+		if _, ok := subscriptions[fromWhere]; ok {
+			return nil, false
 		}
+		// We are not subscribed to the chunk this object is entering from.
+		return bytes, true
 	default:
-		log.Println("handleByteSliceFromRedis: unrecognized header", header)
-		client.toWebSocket <- bytes
+		client.logError("Client.Receive got unrecognized header", "subKey", key, "header", header)
+		return bytes, true
 	}
-	return
+}
+
+// Resync tells the browser that messages on the supplied subscription keys may
+// have been lost, for example because the node's redis subscription
+// connection was interrupted. The browser should discard the objects in those
+// keys, and resubscribe to them.
+//
+// It will be called by the node's Broker.
+func (client *synkClient) Resync(subKeys []string) {
+	// The browser cannot resubscribe to synk's own channels
+	subKeys = withoutReservedKeys(subKeys)
+	if len(subKeys) == 0 {
+		return
+	}
+	if client.backpressure.kind == backpressureResync {
+		client.bpMutex.Lock()
+		for _, subKey := range subKeys {
+			client.resyncKeys[subKey] = true
+		}
+		client.flushResync()
+		client.bpMutex.Unlock()
+		return
+	}
+
+	bytes, err := json.Marshal(resyncMsg{SKeys: subKeys})
+	if err != nil {
+		client.logError("Client.Resync failed to marshal message", "err", err)
+		return
+	}
+	client.send("", bytes)
 }
 
 // The main client loop is responsible for writing to wsConn and the client's
@@ -155,25 +328,50 @@ func (client *synkClient) startMainLoop() {
 
 	defer ticker.Stop()
 	defer client.Close()
-	defer log.Println("Close startMainLoop", client.id)
+	defer func() {
+		if disconnecter, ok := client.custom.(Disconnecter); ok {
+			disconnecter.OnDisconnect(client, client.disconnectReason())
+		}
+		// Once the main loop exits, client.subscriptions will not change
+		client.Node.stats.subscriptions.Add(-int64(len(client.subscriptions)))
+		if client.session != nil {
+			client.session.park(client)
+		}
+	}()
+	defer client.logDebug("Client main loop closed")
+
+	if client.hello != nil {
+		if err := client.write(client.hello); err != nil {
+			return
+		}
+	}
+	for i, message := range client.replay {
+		client.replay[i] = nil
+		if err := client.writeToWebSocket(message); err != nil {
+			return
+		}
+	}
+	client.replay = nil
+	if len(client.restored) > 0 {
+		client.custom.OnSubscribe(client, client.restored, nil)
+		client.restored = nil
+	}
 
 	for {
 		select {
-		case message, ok := <-client.toWebSocket:
-			if !ok {
-				// the client.writeToWebSocket channel was closed up-stream
-				log.Println("Client.writeToWebSocket: go channel was closed")
-				return
-			}
+		case message := <-client.toWebSocket:
 			// We received a message that is intended for the client. Note that if we
 			// return (or break out of the for loop), the message will not be in our
 			// buffer AND will never have reached the client
 			if err := client.writeToWebSocket(message); err != nil {
+				client.setDisconnectReason("write failed: " + err.Error())
 				return
 			}
+			client.relieveBackpressure()
 		case <-ticker.C:
 			client.wsConn.SetWriteDeadline(time.Now().Add(writeTimeout))
 			if err := client.wsConn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+				client.setDisconnectReason("ping failed: " + err.Error())
 				return
 			}
 		// Above this should be logic for writing to the websocket
@@ -194,7 +392,7 @@ func (client *synkClient) startMainLoop() {
 			// when the subscription takes effect.
 			err := client.handleMessage(message)
 			if err != nil {
-				log.Println("Client.writeToWebSocket: Error handling message from client:", err)
+				client.logError("Client failed to handle message", "err", err)
 				// Should this quit/return?
 			}
 		}
@@ -226,24 +424,38 @@ func (client *synkClient) startReadingFromWebSocket() {
 	for {
 		_, bytes, err := client.wsConn.ReadMessage()
 		// Errors from websocket library are expected to be *websocket.CloseError
+		if err != nil {
+			client.setDisconnectReason(err.Error())
+		}
 		if wsErr, ok := err.(*websocket.CloseError); ok {
 			if wsErr.Code == websocket.CloseGoingAway {
-				log.Println("Client closed tab:", client.id)
+				client.logInfo("Client closed tab")
 			} else {
-				log.Println("synk.Client.startReadingFromWebSocket Error:", wsErr)
+				client.logInfo("Client websocket closed", "code", wsErr.Code, "err", wsErr)
 			}
 			break
+		} else if err == websocket.ErrReadLimit {
+			// The websocket library has already sent a close frame
+			client.Node.stats.oversizedMsgs.Inc()
+			client.logInfo("Client sent a message larger than MaxMessageSize")
+			break
 		} else if err != nil {
 			// I don't think this should ever happen, but it can't hurt to double check
-			log.Println("synk.Client.startReadingFromWebSocket Unexpected Read Error:", err)
+			client.logError("Client unexpected websocket read error", "err", err)
 			break
 		}
 
+		bytes, err = client.codec.Decode(bytes)
+		if err != nil {
+			client.logError("Client failed to decode message", "err", err)
+			continue
+		}
+
 		// We successully received bytes. Try to parse them.
 		if message, parseErr := MessageFromBytes(bytes); parseErr != nil {
 			// Failed to parse message. Report error, but don't break out of the loop.
-			log.Println("synk.Client.startReadingFromWebSocket: error parsing bytes:", parseErr)
-		} else {
+			client.logError("Client failed to parse message", "err", parseErr)
+		} else if client.allowMessage(message) {
 			client.fromWebSocket <- message
 		}
 	}
@@ -253,17 +465,27 @@ func (client *synkClient) String() string {
 	return fmt.Sprintf("{Client.ID: %s}", client.id)
 }
 
+// logDebug, logInfo and logError send events to the node's Logger, including
+// the client's ID.
+func (client *synkClient) logDebug(msg string, keyvals ...interface{}) {
+	client.Node.logger.Debug(msg, append([]interface{}{"client", client.ID()}, keyvals...)...)
+}
+
+func (client *synkClient) logInfo(msg string, keyvals ...interface{}) {
+	client.Node.logger.Info(msg, append([]interface{}{"client", client.ID()}, keyvals...)...)
+}
+
+func (client *synkClient) logError(msg string, keyvals ...interface{}) {
+	client.Node.logger.Error(msg, append([]interface{}{"client", client.ID()}, keyvals...)...)
+}
+
 // not safe for concurrent calls
 func (client *synkClient) handleMessage(message interface{}) error {
 	switch msg := message.(type) {
 	case UpdateSubscriptionMessage:
 		client.updateSubscription(msg)
 	case CustomMessage:
-		if client.custom != nil {
-			client.custom.OnMessage(client, msg.Method, msg.Data)
-		} else {
-			return fmt.Errorf("Client.handleMessages does not handle %T", message)
-		}
+		return client.handleCustomMessage(msg)
 	}
 	return nil
 }
@@ -271,23 +493,42 @@ func (client *synkClient) handleMessage(message interface{}) error {
 // subscribe/unsubscribe to the keys in the diff map. This is NOT safe for
 // concurrent calls, and may only be called by a single goroutine
 func (client *synkClient) updateSubscription(msg UpdateSubscriptionMessage) error {
+	msg.Add = client.authorizeSubscription(msg.Add)
+	msg.Add = client.limitSubscriptions(msg.Add, msg.Remove)
 
+	var unsubscribed []string
 	for _, subKey := range msg.Remove {
-		delete(client.subscriptions, subKey)
+		if client.subscriptions[subKey] {
+			delete(client.subscriptions, subKey)
+			client.Node.stats.subscriptions.Dec()
+			if !containsString(msg.Add, subKey) {
+				unsubscribed = append(unsubscribed, subKey)
+			}
+		}
 	}
 	for _, subKey := range msg.Add {
-		client.subscriptions[subKey] = true
+		if !client.subscriptions[subKey] {
+			client.subscriptions[subKey] = true
+			client.Node.stats.subscriptions.Inc()
+		}
 	}
 
-	client.Node.redisAgents.Update(client, msg.Add, msg.Remove)
+	client.Node.broker.Update(client.agent(), msg.Add, msg.Remove)
+
+	if unsubscriber, ok := client.custom.(Unsubscriber); ok && len(unsubscribed) > 0 {
+		unsubscriber.OnUnsubscribe(client, unsubscribed)
+	}
 
 	// Send subscribe request
 	if len(msg.Add) > 0 {
 
+		start := time.Now()
 		objs, err := client.Loader.Load(msg.Add)
+		client.Node.stats.loadSeconds.ObserveSince(start)
 
 		if err != nil {
-			log.Printf("Client.updateSubscription: error geting Objects: %s\n", err)
+			client.logError("Client.updateSubscription failed to load objects",
+				"method", "updateSubscription", "subKeys", msg.Add, "err", err)
 			return err
 		}
 
@@ -298,7 +539,9 @@ func (client *synkClient) updateSubscription(msg UpdateSubscriptionMessage) erro
 		//
 		// We have already updated our subscription, so immediately send the
 		// current state to the web socket.
-		if len(objs) > 0 {
+		if client.Node.batchSize > 0 {
+			client.writeBatches(msg.Add, objs)
+		} else if len(objs) > 0 {
 			for _, obj := range objs {
 				bytes, err := json.Marshal(addMsg{
 					State:   obj.State(),
@@ -308,7 +551,8 @@ func (client *synkClient) updateSubscription(msg UpdateSubscriptionMessage) erro
 					Type:    obj.TypeKey(),
 				})
 				if err != nil {
-					log.Printf("Client.updateSubscription failed to marshal %v\n", obj)
+					client.logError("Client.updateSubscription failed to marshal object",
+						"objectID", obj.TagGetID(), "typeKey", obj.TypeKey(), "err", err)
 				}
 				client.writeToWebSocket(bytes)
 			}
@@ -318,6 +562,134 @@ func (client *synkClient) updateSubscription(msg UpdateSubscriptionMessage) erro
 	return nil
 }
 
+// writeBatches sends the loaded objects grouped by subscription key in
+// addBatch messages, followed by a subscribed message for each of the subKeys.
+// See Node.SetLoadBatchSize. May only be called from the main loop.
+func (client *synkClient) writeBatches(subKeys []string, objs []Object) {
+	bySubKey := make(map[string][]json.RawMessage)
+	order := append([]string(nil), subKeys...)
+	for _, obj := range objs {
+		bytes, err := json.Marshal(addMsg{
+			State:   obj.State(),
+			ID:      obj.TagGetID(),
+			SKey:    obj.GetSubKey(),
+			Version: obj.Version(),
+			Type:    obj.TypeKey(),
+		})
+		if err != nil {
+			client.logError("Client.updateSubscription failed to marshal object",
+				"objectID", obj.TagGetID(), "typeKey", obj.TypeKey(), "err", err)
+			continue
+		}
+		subKey := obj.GetSubKey()
+		if _, ok := bySubKey[subKey]; !ok && !containsString(subKeys, subKey) {
+			order = append(order, subKey)
+		}
+		bySubKey[subKey] = append(bySubKey[subKey], bytes)
+	}
+
+	for _, subKey := range order {
+		adds := bySubKey[subKey]
+
+		// The size of the message with no objects counts toward the batch size
+		envelope, _ := json.Marshal(addBatchMsg{SKey: subKey, Objs: []json.RawMessage{}})
+		for len(adds) > 0 {
+			// Every batch has at least one object, even if it is larger
+			// than the batch size.
+			n, size := 1, len(envelope)+len(adds[0])
+			for n < len(adds) && size+len(adds[n])+1 <= client.Node.batchSize {
+				size += len(adds[n]) + 1
+				n++
+			}
+			bytes, err := json.Marshal(addBatchMsg{SKey: subKey, Objs: adds[:n]})
+			if err != nil {
+				client.logError("Client.updateSubscription failed to marshal batch", "subKey", subKey, "err", err)
+			} else {
+				client.writeToWebSocket(bytes)
+			}
+			adds = adds[n:]
+		}
+		if containsString(subKeys, subKey) {
+			bytes, _ := json.Marshal(subscribedMsg{SKey: subKey})
+			client.writeToWebSocket(bytes)
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeSubscription authorizes the subKeys, and returns the approved
+// keys. Rejected keys are reported to the browser. May only be called from the
+// main loop.
+func (client *synkClient) authorizeSubscription(subKeys []string) []string {
+	approved, rejected := client.authorize(subKeys)
+	if bytes := client.subscriptionError(rejected); bytes != nil {
+		client.reply(bytes)
+	}
+	return approved
+}
+
+// authorize passes each of the subKeys through the client's
+// SubscriptionAuthorizer. Return the approved (and possibly rewritten) keys,
+// and the rejected keys. Keys reserved by synk are always rejected.
+func (client *synkClient) authorize(subKeys []string) ([]string, []string) {
+	auth, ok := client.custom.(SubscriptionAuthorizer)
+	if !ok {
+		auth = client.Node.subAuth
+	}
+	if len(subKeys) == 0 || (auth == nil && !containsReservedKey(subKeys)) {
+		return subKeys, nil
+	}
+
+	approved := make([]string, 0, len(subKeys))
+	seen := make(map[string]bool)
+	var rejected []string
+
+	for _, subKey := range subKeys {
+		authorized, err := subKey, error(nil)
+		if auth != nil && !isReservedKey(subKey) {
+			authorized, err = auth.AuthorizeSubscription(client, subKey)
+		}
+		if err == nil && isReservedKey(authorized) {
+			err = errReservedKey
+		}
+		if err != nil {
+			client.logInfo("Client subscription rejected", "subKey", subKey, "err", err)
+			rejected = append(rejected, subKey)
+			continue
+		}
+		// Two requested keys may be rewritten to the same key
+		if !seen[authorized] {
+			seen[authorized] = true
+			approved = append(approved, authorized)
+		}
+	}
+
+	return approved, rejected
+}
+
+// subscriptionError returns the message that reports rejected keys to the
+// browser, or nil if there are none.
+func (client *synkClient) subscriptionError(rejected []string) []byte {
+	if len(rejected) == 0 {
+		return nil
+	}
+	client.Node.stats.subRejected.Add(uint64(len(rejected)))
+	bytes, err := json.Marshal(subscriptionErrorMsg{SKeys: rejected})
+	if err != nil {
+		client.logError("Client failed to marshal subscriptionError message", "err", err)
+		return nil
+	}
+	return bytes
+}
+
 // Close tears down client resources, and stops client goroutines.
 // Safe for concurrent calls.
 func (client *synkClient) Close() {
@@ -332,24 +704,97 @@ func (client *synkClient) Close() {
 		// close the client.fromWebSocket channel. Closing this channel also
 		// causes the main loop to break.
 		client.wsConn.Close()
+		client.rpcMutex.Lock()
+		close(client.closed)
+		client.rpcMutex.Unlock()
 
 		// Wait for the the main loop to close.
 		for range client.fromWebSocket {
 		}
 
 		// Once the fromWebSocket channel is closed, we are gauranteed not to
-		// get an pub/sub requests from the client.
-		client.Node.redisAgents.RemoveAgent(client)
+		// get an pub/sub requests from the client. The session keeps the
+		// subscriptions, in case the browser reconnects.
+		if client.session != nil {
+			// A resumed session gets the new client's channel
+			client.Node.broker.Update(client.session, nil, []string{clientChannel(client.ID())})
+			client.session.detach(client)
+		} else {
+			client.Node.broker.RemoveAgent(client)
+		}
 
 		client.waitGroup.Done()
 	})
 }
 
+// closeWithReason sends a websocket close frame with the supplied code and
+// reason, closes the client, and calls the node's DisconnectHandler. Safe for
+// concurrent calls. Only the first call sends a close frame.
+//
+// The browser was told why it was closed, so its session cannot be resumed.
+func (client *synkClient) closeWithReason(code int, reason string) {
+	client.reasonOnce.Do(func() {
+		client.setDisconnectReason(reason)
+		if client.session != nil {
+			client.session.end()
+		}
+		msg := websocket.FormatCloseMessage(code, reason)
+		client.wsConn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeTimeout))
+		client.Close()
+		if client.Node.onDisconnect != nil {
+			client.Node.onDisconnect(client, code, reason)
+		}
+	})
+	client.Close()
+}
+
+// setDisconnectReason records why the client is disconnecting, unless a
+// reason was already recorded. Safe for concurrent calls.
+func (client *synkClient) setDisconnectReason(reason string) {
+	client.reasonMutex.Lock()
+	if client.reason == "" {
+		client.reason = reason
+	}
+	client.reasonMutex.Unlock()
+}
+
+func (client *synkClient) disconnectReason() string {
+	client.reasonMutex.Lock()
+	defer client.reasonMutex.Unlock()
+	return client.reason
+}
+
 // May only be called from the mainLoop. Not safe for concurrent calls.
 func (client *synkClient) writeToWebSocket(message []byte) error {
+	if client.session != nil {
+		client.session.written(message)
+	}
+	return client.write(message)
+}
+
+// reply writes a message to the browser while handling one of its messages.
+// The main loop is the only goroutine that takes messages from toWebSocket, so
+// if it sent to the full channel, it would wait forever. reply writes to the
+// websocket directly instead. May only be called from the mainLoop.
+func (client *synkClient) reply(message []byte) error {
+	return client.writeToWebSocket(message)
+}
+
+// write a message to the websocket without logging it in the session. May only
+// be called from the mainLoop.
+func (client *synkClient) write(message []byte) error {
+	message, err := client.codec.Encode(message)
+	if err != nil {
+		// Don't close the connection because of one bad message
+		client.logError("Client failed to encode message", "err", err)
+		return nil
+	}
+
+	// This has no effect if the browser did not negotiate compression
+	client.wsConn.EnableWriteCompression(client.compress >= 0 && len(message) >= client.compress)
 	client.wsConn.SetWriteDeadline(time.Now().Add(writeTimeout))
-	if err := client.wsConn.WriteMessage(websocket.TextMessage, message); err != nil {
-		log.Println("Client: Error Writing to websocket:", err)
+	if err := client.wsConn.WriteMessage(client.codec.MessageType(), message); err != nil {
+		client.logInfo("Client failed to write to websocket", "err", err)
 		return err
 	}
 	return nil
@@ -360,5 +805,8 @@ func (client *synkClient) WriteToWebSocket(data []byte) {
 	// While this is the same as just sending data to the toWebSocket channel, this
 	// method is exported while the channel is not. This way it is harder for client
 	// code to accidentally overwrite the channel.
-	client.toWebSocket <- data
+	select {
+	case client.toWebSocket <- data:
+	case <-client.closed:
+	}
 }
@@ -3,19 +3,30 @@ package synk
 // ClientPool is a collection of client that we can add, remove or broadcast to
 // safely from multiple goroutines.
 type ClientPool struct {
-	// send a client here to create
-	add       chan *synkClient
-	remove    chan *synkClient
+	addReq    chan *synkClient
+	removeReq chan *synkClient
 	all       map[ID]*synkClient
 	broadcast chan []byte
+	listReq   chan chan []*synkClient
+	getReq    chan poolGet
+	done      chan struct{}
+}
+
+// poolGet asks the run goroutine for the client with id
+type poolGet struct {
+	id     ID
+	result chan *synkClient
 }
 
 func newClientPool() *ClientPool {
 	pool := ClientPool{
-		add:       make(chan *synkClient),
-		remove:    make(chan *synkClient),
+		addReq:    make(chan *synkClient),
+		removeReq: make(chan *synkClient),
 		all:       make(map[ID]*synkClient),
 		broadcast: make(chan []byte),
+		listReq:   make(chan chan []*synkClient),
+		getReq:    make(chan poolGet),
+		done:      make(chan struct{}),
 	}
 	return &pool
 }
@@ -23,11 +34,10 @@ func newClientPool() *ClientPool {
 func (pool *ClientPool) run() {
 	for {
 		select {
-		case client := <-pool.add:
+		case client := <-pool.addReq:
 			pool.all[client.id] = client
-		case client := <-pool.remove:
+		case client := <-pool.removeReq:
 			if _, ok := pool.all[client.id]; ok {
-				close(client.toWebSocket)
 				delete(pool.all, client.id)
 			}
 		case message := <-pool.broadcast:
@@ -35,9 +45,77 @@ func (pool *ClientPool) run() {
 				select {
 				case client.toWebSocket <- message:
 				default:
-					// buffer overrun
+					// The pool must not wait for a slow client
+					client.dropBroadcast()
 				}
 			}
+		case result := <-pool.listReq:
+			clients := make([]*synkClient, 0, len(pool.all))
+			for _, client := range pool.all {
+				clients = append(clients, client)
+			}
+			result <- clients
+		case req := <-pool.getReq:
+			req.result <- pool.all[req.id]
+		case <-pool.done:
+			return
 		}
 	}
 }
+
+// add client to the pool. Once the pool is stopped, add does nothing.
+func (pool *ClientPool) add(client *synkClient) {
+	select {
+	case pool.addReq <- client:
+	case <-pool.done:
+	}
+}
+
+// remove client from the pool. Once the pool is stopped, remove does nothing.
+func (pool *ClientPool) remove(client *synkClient) {
+	select {
+	case pool.removeReq <- client:
+	case <-pool.done:
+	}
+}
+
+// list returns a snapshot of the clients in the pool.
+func (pool *ClientPool) list() []*synkClient {
+	result := make(chan []*synkClient, 1)
+	select {
+	case pool.listReq <- result:
+		return <-result
+	case <-pool.done:
+		return nil
+	}
+}
+
+// send message to every client in the pool. Clients with a full buffer
+// miss the message.
+func (pool *ClientPool) send(message []byte) {
+	select {
+	case pool.broadcast <- message:
+	case <-pool.done:
+	}
+}
+
+// get returns the client with the given ID, or nil if it is not in the pool.
+func (pool *ClientPool) get(id string) *synkClient {
+	if len(id) != idLen {
+		return nil
+	}
+	req := poolGet{result: make(chan *synkClient, 1)}
+	copy(req.id[:], id)
+	select {
+	case pool.getReq <- req:
+		return <-req.result
+	case <-pool.done:
+		return nil
+	}
+}
+
+// stop the run goroutine. Only call stop once. Clients that are still
+// running may call add and remove after stop, but are not tracked.
+func (pool *ClientPool) stop() {
+	close(pool.done)
+}
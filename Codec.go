@@ -0,0 +1,46 @@
+package synk
+
+import (
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// A Codec converts messages between JSON, which synk uses internally, and the
+// format sent over a client's websocket.
+//
+// Every message inside synk is JSON: the add, mod and rem messages published
+// by Mutators, the bytes passed to Client.WriteToWebSocket, and the data
+// passed to CustomClient.OnMessage. A Codec only changes what travels over
+// the wire, so CustomClients work the same way with every Codec.
+type Codec interface {
+	// Encode converts a JSON message to the wire format.
+	Encode(msg []byte) ([]byte, error)
+
+	// Decode converts a message received from the browser to JSON.
+	Decode(data []byte) ([]byte, error)
+
+	// MessageType is the websocket message type used for encoded messages.
+	// Either websocket.TextMessage or websocket.BinaryMessage.
+	MessageType() int
+}
+
+// JSON is the default Codec. It sends messages unchanged, as text.
+var JSON Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(msg []byte) ([]byte, error)  { return msg, nil }
+func (jsonCodec) Decode(data []byte) ([]byte, error) { return data, nil }
+func (jsonCodec) MessageType() int                   { return websocket.TextMessage }
+
+// selectCodec returns the first websocket subprotocol requested by the browser
+// that has a Codec in codecs. If there is none, return "" and the JSON Codec.
+func selectCodec(r *http.Request, codecs map[string]Codec) (string, Codec) {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if codec, ok := codecs[protocol]; ok {
+			return protocol, codec
+		}
+	}
+	return "", JSON
+}
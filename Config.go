@@ -0,0 +1,214 @@
+package synk
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// Config describes the services that a Node connects to. Create a Config with
+// DefaultConfig or ConfigFromEnv, adjust any fields, and pass it to
+// NewNodeWithConfig. Each Node keeps its own copy of the Config, so a single
+// process may run several Nodes against different backends.
+type Config struct {
+	// RedisAddr is the host:port of the redis server. If no port is
+	// specified ":6379" is used. If no host is specified redis's default
+	// (127.0.0.1) is used.
+	RedisAddr string
+
+	// RedisMaxIdle is the maximum number of idle connections kept in the
+	// redis connection pool.
+	RedisMaxIdle int
+
+	// RedisMaxActive is the maximum number of connections allocated by the
+	// redis pool at a given time. Zero means there is no limit.
+	RedisMaxActive int
+
+	// RedisIdleTimeout closes pooled redis connections after remaining idle
+	// for this duration.
+	RedisIdleTimeout time.Duration
+
+	// RedisDialTimeout is how long we wait while establishing a new
+	// connection to redis.
+	RedisDialTimeout time.Duration
+
+	// RedisReconnectMin and RedisReconnectMax bound the exponential backoff
+	// used when the pub/sub subscription connection must be redialed.
+	RedisReconnectMin time.Duration
+	RedisReconnectMax time.Duration
+
+	// RedisDial, if set, replaces the dialer used by DialRedis, the redis
+	// pool and the RedisBroker. The RedisAddr and RedisDialTimeout fields are
+	// then ignored. Tests may use it to provide fake connections.
+	//
+	// Connections should implement redis.ConnWithTimeout, like the ones made
+	// by redis.Dial. Otherwise the RedisBroker and Node.Health cannot time out
+	// while waiting for redis, so a half-open connection may go unnoticed.
+	RedisDial func() (redis.Conn, error)
+
+	// MongoAddr is the mongodb address. Check the mgo docs to see how ports
+	// are specified. If MongoAddr is empty, the Node does not connect to
+	// mongodb.
+	MongoAddr string
+
+	// MongoDBName is the name of the mongodb database that stores objects.
+	MongoDBName string
+
+	// MongoCollection is the name of the collection that stores objects.
+	MongoCollection string
+
+	// MongoUser and MongoPass may optionally be used to authenticate with
+	// mongod. If they are both empty, we will not try to authenticate. Note
+	// that mongo auth credentials are tied to a mongo database, and these
+	// credentials should match MongoDBName.
+	MongoUser string
+	MongoPass string
+
+	// MongoDialTimeout is how long we wait while establishing the initial
+	// mongodb session.
+	MongoDialTimeout time.Duration
+
+	// Logger receives the Node's log events. If nil, events are written
+	// with the standard library's log package.
+	Logger Logger
+
+	// Backend creates the Mutators and Loaders handed out by the Node. If
+	// nil, NewNodeWithConfig chooses a MongoBackend or a RedisBackend
+	// depending on whether MongoAddr is set.
+	Backend Backend
+}
+
+// DefaultConfig returns a Config for redis and mongodb servers running on
+// localhost with their default ports.
+func DefaultConfig() Config {
+	return Config{
+		RedisAddr:         ":6379",
+		RedisMaxIdle:      100,
+		RedisIdleTimeout:  240 * time.Second,
+		RedisDialTimeout:  8 * time.Second,
+		RedisReconnectMin: defaultReconnectMin,
+		RedisReconnectMax: defaultReconnectMax,
+		MongoAddr:         "localhost",
+		MongoDBName:       "synk",
+		MongoCollection:   "objects",
+		MongoDialTimeout:  10 * time.Second,
+	}
+}
+
+// ConfigFromEnv returns the DefaultConfig, overridden by any of the following
+// environment variables that are set:
+//
+// SYNK_REDIS_ADDR=127.0.0.2
+// SYNK_REDIS_ADDR=127.0.0.3:5555
+// SYNK_MONGO_ADDR=localhost
+// SYNK_MONGO_DB=synk
+// SYNK_MONGO_USER=username
+// SYNK_MONGO_PASS=password
+func ConfigFromEnv() Config {
+	cfg := DefaultConfig()
+
+	if addr := os.Getenv("SYNK_REDIS_ADDR"); addr != "" {
+		cfg.RedisAddr = addr
+	}
+	if addr := os.Getenv("SYNK_MONGO_ADDR"); addr != "" {
+		cfg.MongoAddr = addr
+	}
+	if name := os.Getenv("SYNK_MONGO_DB"); name != "" {
+		cfg.MongoDBName = name
+	}
+	cfg.MongoUser = os.Getenv("SYNK_MONGO_USER")
+	cfg.MongoPass = os.Getenv("SYNK_MONGO_PASS")
+
+	return cfg
+}
+
+// redisAddr returns the RedisAddr with a port. redigo accepts just a host
+// number, which causes it to bind to 127.0.0.1
+func (cfg Config) redisAddr() string {
+	if !strings.Contains(cfg.RedisAddr, ":") {
+		return cfg.RedisAddr + ":6379"
+	}
+	return cfg.RedisAddr
+}
+
+// mongoLoginRequired is true if a mongo user or pass is specified
+func (cfg Config) mongoLoginRequired() bool {
+	return cfg.MongoUser != "" || cfg.MongoPass != ""
+}
+
+// String summarizes the configuration without including the mongo password.
+func (cfg Config) String() string {
+	return fmt.Sprintf("{Redis: %s, Mongo: %s/%s.%s, MongoUser: %q}",
+		cfg.redisAddr(), cfg.MongoAddr, cfg.MongoDBName, cfg.MongoCollection, cfg.MongoUser)
+}
+
+// DialRedisPool creates a redigo connection pool using the Config. Connections
+// are dialed lazily. If dialing fails, pool.Get() returns a connection whose
+// methods return an ErrBackendUnavailable error.
+func (cfg Config) DialRedisPool() *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     cfg.RedisMaxIdle,
+		MaxActive:   cfg.RedisMaxActive,
+		IdleTimeout: cfg.RedisIdleTimeout,
+		Dial:        cfg.DialRedis,
+	}
+}
+
+// DialRedis gets a single redis connection using the Config.
+func (cfg Config) DialRedis() (redis.Conn, error) {
+	if cfg.RedisDial != nil {
+		conn, err := cfg.RedisDial()
+		if _, ok := conn.(redis.ConnWithTimeout); err == nil && !ok {
+			conn = noTimeoutConn{conn}
+		}
+		return conn, err
+	}
+	conn, err := redis.Dial("tcp", cfg.redisAddr(), redis.DialConnectTimeout(cfg.RedisDialTimeout))
+	if err != nil {
+		return nil, &Error{Op: "DialRedis", Kind: ErrBackendUnavailable, Err: err}
+	}
+	return conn, nil
+}
+
+// DialMongo creates the first MongoSession using the Config. Further sessions
+// should be created with session.Copy()
+func (cfg Config) DialMongo() (*mgo.Session, error) {
+	session, err := mgo.DialWithTimeout(cfg.MongoAddr, cfg.MongoDialTimeout)
+	if err != nil {
+		return nil, &Error{Op: "DialMongo", Kind: ErrBackendUnavailable, Err: err}
+	}
+
+	if cfg.mongoLoginRequired() {
+		err = session.Login(&mgo.Credential{
+			Username:  cfg.MongoUser,
+			Password:  cfg.MongoPass,
+			Source:    cfg.MongoDBName,
+			Mechanism: "SCRAM-SHA-1",
+		})
+		if err != nil {
+			session.Close()
+			return nil, &Error{Op: "DialMongo", Kind: ErrBackendUnavailable, Err: err}
+		}
+	}
+
+	return session, nil
+}
+
+// noTimeoutConn lets a redis.Conn that does not implement
+// redis.ConnWithTimeout be used where a timeout is requested. The timeout is
+// ignored.
+type noTimeoutConn struct {
+	redis.Conn
+}
+
+func (c noTimeoutConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	return c.Do(cmd, args...)
+}
+
+func (c noTimeoutConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	return c.Receive()
+}
@@ -0,0 +1,61 @@
+package synk
+
+import (
+	"errors"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Every client listens for direct messages on its own channel. See
+// Node.SendToClient.
+const clientChannelPrefix = reservedPrefix + "client:"
+
+func clientChannel(id string) string {
+	return clientChannelPrefix + id
+}
+
+// ErrOnlineUnknown is returned by SendToClient when the message was published,
+// but the node cannot count the clients that received it. This happens when
+// the node has neither a MemoryBroker nor a redis pool.
+var ErrOnlineUnknown = errors.New("synk: message published, but cannot tell if the client is online")
+
+// SendToClient sends msg to the client with the given ID, which may be
+// connected to any node that shares this node's redis server. If msg is a
+// []byte, it is sent directly. Otherwise it is marshaled to JSON. Either way,
+// it must be a JSON object, such as:
+//
+// {"method":"whisper","from":"alice","text":"hi"}
+//
+// SendToClient reports if the client was online. A client that disconnected
+// is offline, even if its session may still be resumed. If the node cannot
+// tell, SendToClient returns false and ErrOnlineUnknown. Like other messages,
+// a direct message may be dropped by the client's BackpressurePolicy.
+func (node *Node) SendToClient(clientID string, msg interface{}) (bool, error) {
+	receivers, err := node.publishCount("Node.SendToClient", clientChannel(clientID), msg)
+	return receivers > 0, err
+}
+
+// publishCount publishes like publish, and returns the number of Agents that
+// received the message. If they cannot be counted, it returns
+// ErrOnlineUnknown after publishing.
+func (node *Node) publishCount(op, channel string, msg interface{}) (int, error) {
+	if mb, ok := node.broker.(*MemoryBroker); ok {
+		receivers := mb.subscribers(channel)
+		return receivers, mb.Publish(channel, msg)
+	}
+	if node.redisPool == nil {
+		if err := node.publish(op, channel, msg); err != nil {
+			return 0, err
+		}
+		return 0, ErrOnlineUnknown
+	}
+
+	bytes, err := marshalMessage(msg)
+	if err != nil {
+		return 0, err
+	}
+	conn := node.redisPool.Get()
+	defer conn.Close()
+	receivers, err := redis.Int(conn.Do("PUBLISH", channel, bytes))
+	return receivers, redisError(op, err)
+}
@@ -0,0 +1,133 @@
+package synk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Subscription keys with this prefix are reserved for synk's own channels.
+// Browsers cannot subscribe to them.
+const reservedPrefix = "synk:"
+
+// Every node listens for Disconnect requests on this channel.
+const disconnectChannel = reservedPrefix + "disconnect"
+
+// The longest reason allowed in a websocket close frame
+const maxCloseReason = 123
+
+var errReservedKey = errors.New("subscription key is reserved")
+
+func isReservedKey(subKey string) bool {
+	return strings.HasPrefix(subKey, reservedPrefix)
+}
+
+// withoutReservedKeys returns subKeys, without the keys reserved by synk
+func withoutReservedKeys(subKeys []string) []string {
+	if !containsReservedKey(subKeys) {
+		return subKeys
+	}
+	result := make([]string, 0, len(subKeys))
+	for _, subKey := range subKeys {
+		if !isReservedKey(subKey) {
+			result = append(result, subKey)
+		}
+	}
+	return result
+}
+
+func containsReservedKey(subKeys []string) bool {
+	for _, subKey := range subKeys {
+		if isReservedKey(subKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// A DisconnectHandler is called after a client is disconnected by the server
+// with a websocket close frame. code and reason are the contents of the frame.
+type DisconnectHandler func(client Client, code int, reason string)
+
+// SetDisconnectHandler sets a function that is called on the client's node
+// after a client is disconnected by the server: by Disconnect, by Shutdown,
+// or for breaking the node's BackpressurePolicy or ClientLimits. It is not
+// called when the browser disconnects. The handler is called at most once per
+// client, but may be called concurrently for different clients.
+func (node *Node) SetDisconnectHandler(handler DisconnectHandler) {
+	node.onDisconnect = handler
+}
+
+// Disconnect closes the client with the given ID, which may be connected to
+// any node that shares this node's redis server. The browser is sent a close
+// frame with code and reason, which must be a valid websocket close code and
+// at most 123 bytes long. Codes 4000-4999 are for applications.
+//
+// The request is published to every node, so Disconnect returns before the
+// client is closed, and returns nil even if no client has the ID. The session
+// of a disconnected client cannot be resumed.
+func (node *Node) Disconnect(clientID string, code int, reason string) error {
+	if code < 1000 || code >= 5000 {
+		return fmt.Errorf("synk.Node.Disconnect: invalid close code %d", code)
+	}
+	if len(reason) > maxCloseReason {
+		return fmt.Errorf("synk.Node.Disconnect: reason is longer than %d bytes", maxCloseReason)
+	}
+	return node.publish("Node.Disconnect", disconnectChannel, disconnectMsg{ID: clientID, Code: code, Reason: reason})
+}
+
+// publish a message to every node. If the message is a []byte, publish it
+// directly. Otherwise Marshal it to JSON. op names the caller in errors.
+func (node *Node) publish(op, channel string, msg interface{}) error {
+	if publisher, ok := node.broker.(interface {
+		Publish(channel string, msg interface{}) error
+	}); ok {
+		return publisher.Publish(channel, msg)
+	}
+	if node.redisPool == nil {
+		return &Error{Op: op, Kind: ErrBackendUnavailable, Err: errors.New("node has no redis pool")}
+	}
+
+	bytes, err := marshalMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	conn := node.redisPool.Get()
+	defer conn.Close()
+	_, err = conn.Do("PUBLISH", channel, bytes)
+	return redisError(op, err)
+}
+
+// disconnectMsg is published on the disconnectChannel by Node.Disconnect
+type disconnectMsg struct {
+	ID     string `json:"id"`
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// nodeAgent receives the messages published on synk's reserved channels. Each
+// node subscribes one nodeAgent with its Broker.
+type nodeAgent struct {
+	node *Node
+}
+
+func (agent *nodeAgent) Receive(channel string, data []byte) error {
+	switch channel {
+	case broadcastChannel:
+		agent.node.BroadcastLocal(data)
+	case disconnectChannel:
+		var msg disconnectMsg
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return err
+		}
+		if client := agent.node.clients.get(msg.ID); client != nil {
+			agent.node.stats.kicked.Inc()
+			client.logInfo("Client disconnected by Node.Disconnect", "code", msg.Code, "reason", msg.Reason)
+			// Don't keep the Broker waiting while the client closes
+			go client.closeWithReason(msg.Code, msg.Reason)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package synk
+
+import (
+	"errors"
+
+	"github.com/garyburd/redigo/redis"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// These errors describe why a Mutator, Loader or dial helper failed. They are
+// never returned directly. Instead they are wrapped in an *Error, so check for
+// them with errors.Is:
+//
+// if errors.Is(err, synk.ErrNotFound) { ... }
+var (
+	// ErrNotFound means the object does not exist in the backend.
+	ErrNotFound = errors.New("object not found")
+
+	// ErrConflict means an object with the same ID already exists.
+	ErrConflict = errors.New("object already exists")
+
+	// ErrBackendUnavailable means we could not communicate with mongodb or
+	// redis. The operation may or may not have been applied.
+	ErrBackendUnavailable = errors.New("backend unavailable")
+
+	// ErrPublishFailed means that the object was written to the database,
+	// but the message to clients could not be published. Clients subscribed
+	// to the object may be out of sync until they resubscribe.
+	ErrPublishFailed = errors.New("publish failed after write")
+)
+
+// Error is returned by synk operations that fail. Kind is one of the Err*
+// values above, and Err is the underlying error, if any.
+type Error struct {
+	Op   string // The operation that failed. Ex: "MongoSynk.Modify"
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return "synk." + e.Op + ": " + e.Kind.Error()
+	}
+	return "synk." + e.Op + ": " + e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Is reports if target is the Kind of the error. This lets errors.Is match
+// the Err* values.
+func (e *Error) Is(target error) bool {
+	return e.Kind == target
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// mongoError wraps an error returned by mgo in an *Error with the
+// appropriate Kind. Return nil if err is nil.
+func mongoError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	kind := ErrBackendUnavailable
+	if err == mgo.ErrNotFound {
+		kind = ErrNotFound
+	} else if mgo.IsDup(err) {
+		kind = ErrConflict
+	}
+	return &Error{Op: op, Kind: kind, Err: err}
+}
+
+// redisError wraps a connection error returned by redigo in an *Error with
+// the ErrBackendUnavailable Kind. Errors replied by the redis server (for
+// example, a failed script) are not caused by an outage, so they are returned
+// unchanged. Return nil if err is nil.
+func redisError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(redis.Error); ok {
+		return err
+	}
+	return &Error{Op: op, Kind: ErrBackendUnavailable, Err: err}
+}
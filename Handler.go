@@ -1,55 +1,301 @@
 package synk
 
 import (
-	"log"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
+// defaultBufferSize is the websocket read and write buffer size used when
+// UpgradeOptions does not specify one.
+const defaultBufferSize = 1024
+
+// UpgradeOptions configure the websocket handshake performed by a Handler.
+// The zero value accepts requests from any origin, and uses 1024 byte
+// buffers.
+//
+// Browsers send an Origin header with every websocket request. Requests
+// without one (for example from command line tools) are always accepted,
+// because any client that does not run in a browser can forge the header
+// anyway.
+type UpgradeOptions struct {
+	// AllowedOrigins lists the origins that may open a websocket, for example
+	// "https://example.com". A "*" in a pattern matches any sequence of
+	// characters, so "https://*.example.com" matches every subdomain. Origins
+	// are compared case insensitively. If AllowedOrigins is empty, any origin
+	// is accepted unless RejectCrossSite is set.
+	//
+	// Requests without an Origin header, and requests whose Origin host equals
+	// the request's Host, are always accepted. They do not need to be listed.
+	AllowedOrigins []string
+
+	// RejectCrossSite rejects requests whose Origin host differs from the
+	// request's Host, unless the origin is in AllowedOrigins.
+	RejectCrossSite bool
+
+	// ReadBufferSize and WriteBufferSize are the sizes of the websocket I/O
+	// buffers in bytes. If zero, 1024 is used.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// HandshakeTimeout is the time limit for completing the handshake. If
+	// zero, there is no limit.
+	HandshakeTimeout time.Duration
+
+	// EnableCompression negotiates per message compression (RFC 7692) with
+	// browsers that support it. Subscription loads and mod messages are very
+	// repetitive, so they compress well.
+	EnableCompression bool
+
+	// CompressionLevel is the flate compression level used for outgoing
+	// messages, from flate.BestSpeed (1) to flate.BestCompression (9). If
+	// zero, flate.BestSpeed is used.
+	CompressionLevel int
+
+	// CompressionThreshold is the size in bytes below which messages are sent
+	// uncompressed, because the compression overhead outweighs the savings.
+	CompressionThreshold int
+}
+
+func (opts UpgradeOptions) upgrader() *websocket.Upgrader {
+	upgrader := &websocket.Upgrader{
+		ReadBufferSize:    opts.ReadBufferSize,
+		WriteBufferSize:   opts.WriteBufferSize,
+		HandshakeTimeout:  opts.HandshakeTimeout,
+		CheckOrigin:       opts.checkOrigin,
+		EnableCompression: opts.EnableCompression,
+	}
+	if upgrader.ReadBufferSize == 0 {
+		upgrader.ReadBufferSize = defaultBufferSize
+	}
+	if upgrader.WriteBufferSize == 0 {
+		upgrader.WriteBufferSize = defaultBufferSize
+	}
+	return upgrader
+}
+
+// checkOrigin reports if the request's Origin is acceptable. Same host origins
+// are always acceptable.
+func (opts UpgradeOptions) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
 		return true
-	},
+	}
+	for _, pattern := range opts.AllowedOrigins {
+		if matchWildcard(strings.ToLower(pattern), strings.ToLower(origin)) {
+			return true
+		}
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return len(opts.AllowedOrigins) == 0 && !opts.RejectCrossSite
+}
+
+// matchWildcard reports if s matches pattern, where each "*" in pattern
+// matches any sequence of characters.
+func matchWildcard(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+
+	// The first part is anchored at the start, and the last at the end
+	first, last := parts[0], parts[len(parts)-1]
+	if len(s) < len(first)+len(last) || !strings.HasPrefix(s, first) || !strings.HasSuffix(s, last) {
+		return false
+	}
+	s = s[len(first) : len(s)-len(last)]
+
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i == -1 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return true
+}
+
+// A ClientSelector chooses which of the node's ClientConstructors will create
+// the CustomClient for a request. It returns the name passed to
+// Node.RegisterNamedClientConstructor, or "" for the constructor registered
+// with Node.RegisterClientConstructor.
+type ClientSelector func(r *http.Request) string
+
+// SelectByPath returns a ClientSelector that selects the constructor named by
+// the rest of the URL path after prefix, where the Handler is mounted. For
+// example, if prefix is "/ws", the URL "/ws/spectator" selects "spectator".
+// The prefix itself, and paths that are not under it, select the default
+// constructor.
+func SelectByPath(prefix string) ClientSelector {
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	return func(r *http.Request) string {
+		name := path.Clean(r.URL.Path)
+		if !strings.HasPrefix(name, prefix) {
+			return ""
+		}
+		return strings.TrimPrefix(name, prefix)
+	}
+}
+
+// SelectByQuery returns a ClientSelector that selects the constructor named
+// by the query parameter param. For example, if param is "kind", the URL
+// "/ws?kind=editor" selects "editor".
+func SelectByQuery(param string) ClientSelector {
+	return func(r *http.Request) string {
+		return r.URL.Query().Get(param)
+	}
+}
+
+// SelectBySubprotocol returns a ClientSelector that selects the first
+// websocket subprotocol requested by the browser that is included in names.
+// The selected subprotocol is sent back to the browser in the handshake.
+func SelectBySubprotocol(names ...string) ClientSelector {
+	return func(r *http.Request) string {
+		for _, protocol := range websocket.Subprotocols(r) {
+			for _, name := range names {
+				if protocol == name {
+					return name
+				}
+			}
+		}
+		return ""
+	}
 }
 
 // Handler upgrades http requests to websockets. Each new request will have a
 // websocket connection. Made to be used with the http.Handle function.
+//
+// Once the Node begins shutting down, the Handler responds to new requests
+// with 503 Service Unavailable.
 type Handler struct {
-	clientPool *ClientPool
-	Node       *Node
+	Node *Node
+
+	// Select chooses the ClientConstructor for each request. If Select is
+	// nil, or returns "", the constructor registered with
+	// Node.RegisterClientConstructor is used. If Select returns a name that
+	// is not registered, the request is rejected with 404 Not Found.
+	Select ClientSelector
+
+	// Authenticator identifies the user behind each request before it is
+	// upgraded. If nil, the node's Authenticator is used. See
+	// Node.SetAuthenticator.
+	Authenticator Authenticator
+
+	// Upgrade configures the websocket handshake, including which origins
+	// may connect. See UpgradeOptions.
+	Upgrade UpgradeOptions
+
+	// Codecs maps websocket subprotocols to the Codec used for clients that
+	// request them. Clients that request none of the subprotocols use JSON.
+	//
+	// If the browser requests both a Codec subprotocol and a subprotocol
+	// chosen by SelectBySubprotocol, the Codec's subprotocol is confirmed in
+	// the handshake.
+	Codecs map[string]Codec
 }
 
 // NewHandler creates a WsHandler for use with http.Handle
 func NewHandler(node *Node) *Handler {
-	h := &Handler{
-		Node:       node,
-		clientPool: newClientPool(),
+	return &Handler{
+		Node: node,
 	}
+}
 
-	go h.clientPool.run()
-
-	return h
+// NewNamedHandler creates a Handler that always uses the ClientConstructor
+// registered with name. Use it to serve different kinds of clients on
+// different endpoints:
+//
+// http.Handle("/player", synk.NewNamedHandler(node, "player"))
+// http.Handle("/editor", synk.NewNamedHandler(node, "editor"))
+func NewNamedHandler(node *Node, name string) *Handler {
+	return &Handler{
+		Node:   node,
+		Select: func(r *http.Request) string { return name },
+	}
 }
 
 func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var name string
+	if h.Select != nil {
+		name = h.Select(r)
+	}
+
+	constructor, ok := h.Node.clientConstructor(name)
+	if !ok {
+		http.Error(w, "unknown synk client: "+name, http.StatusNotFound)
+		return
+	}
+
+	auth := h.Authenticator
+	if auth == nil {
+		auth = h.Node.auth
+	}
+
+	opts := clientOptions{compressThreshold: -1, codec: JSON}
+	if token := r.URL.Query().Get("resume"); token != "" {
+		opts.resumeToken = token
+		opts.received, _ = strconv.ParseUint(r.URL.Query().Get("received"), 10, 64)
+	}
+	if auth != nil {
+		var err error
+		if opts.principal, err = auth.Authenticate(r); err != nil {
+			h.Node.stats.authFailures.Inc()
+			h.Node.logger.Info("Handler rejected unauthenticated request", "err", err)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// If the client was selected by subprotocol, confirm it in the handshake
+	var header http.Header
+	for _, protocol := range websocket.Subprotocols(r) {
+		if name != "" && protocol == name {
+			header = http.Header{"Sec-Websocket-Protocol": {name}}
+			break
+		}
+	}
+	if protocol, codec := selectCodec(r, h.Codecs); protocol != "" {
+		header = http.Header{"Sec-Websocket-Protocol": {protocol}}
+		opts.codec = codec
+	}
+
+	if !h.Node.beginConnection() {
+		http.Error(w, "synk node is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.Node.endConnection()
 
 	// Get a pointer to a websocket connection
-	wsConn, err := upgrader.Upgrade(w, r, nil)
+	wsConn, err := h.Upgrade.upgrader().Upgrade(w, r, header)
 
 	if err != nil {
-		log.Println("ws upgrade error:", err)
+		h.Node.stats.upgradeErrors.Inc()
+		h.Node.logger.Info("Handler failed to upgrade websocket", "err", err)
 		// July 18, 2017: calling wsConn.Close() panics
 		return
 	}
 
+	if h.Upgrade.EnableCompression {
+		opts.compressThreshold = h.Upgrade.CompressionThreshold
+		if h.Upgrade.CompressionLevel != 0 {
+			if err := wsConn.SetCompressionLevel(h.Upgrade.CompressionLevel); err != nil {
+				h.Node.logger.Error("Handler failed to set compression level", "err", err)
+			}
+		}
+	}
+
 	// create a new Client object
-	client, err := newClient(h.Node, wsConn)
+	client, err := newClient(h.Node, wsConn, constructor, opts)
 
 	if err != nil {
-		log.Println("Failed to create Client:", err)
+		h.Node.logger.Error("Handler failed to create client", "err", err)
 		wsConn.Close()
 		return
 	}
@@ -57,7 +303,18 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Now that the client was created successfully, It is the client's
 	// responsibility to close the wsConn
 
-	h.clientPool.add <- client
+	h.Node.clients.add(client)
+	h.Node.stats.connections.Inc()
+	h.Node.stats.clients.Inc()
+
+	// If Shutdown was called while we were creating the client, it might not
+	// have been in the pool when Shutdown closed the other clients.
+	if h.Node.isClosing() {
+		client.closeWithReason(websocket.CloseServiceRestart, shutdownReason)
+	}
+
 	client.waitGroup.Wait()
-	h.clientPool.remove <- client
+	client.rpcs.Wait()
+	h.Node.clients.remove(client)
+	h.Node.stats.clients.Dec()
 }
@@ -0,0 +1,130 @@
+package synk
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// Each dependency check fails if it takes longer than this
+const healthCheckTimeout = 2 * time.Second
+
+// HealthStatus reports if a Node can serve clients. It is the JSON body
+// written by the node's HealthHandler.
+type HealthStatus struct {
+	// Ready is true if every check passed, and the node is not shutting
+	// down.
+	Ready bool `json:"ready"`
+
+	// ShuttingDown is true once Node.Shutdown has been called.
+	ShuttingDown bool `json:"shuttingDown"`
+
+	// Clients is the number of connected clients.
+	Clients int64 `json:"clients"`
+
+	// Checks maps the name of each service the node depends on to "ok", or
+	// to a description of the failure. Services that the node does not use
+	// are omitted.
+	Checks map[string]string `json:"checks"`
+}
+
+// brokerConn is implemented by Brokers that can report the state of their
+// connection.
+type brokerConn interface {
+	Connected() bool
+}
+
+// Health checks the services the node depends on:
+//
+//   - "redis" - PING via the redis pool
+//   - "mongo" - Ping the mongodb session
+//   - "broker" - the Broker's subscription connection is up
+//
+// Once Shutdown is called, the node is not ready, and no checks are made.
+func (node *Node) Health() HealthStatus {
+	status := HealthStatus{
+		Clients: node.stats.clients.Value(),
+		Checks:  make(map[string]string),
+	}
+
+	// Shutdown closes the pool and the session once closing is set, so they
+	// must be acquired while holding the mutex.
+	var conn redis.Conn
+	var session *mgo.Session
+	node.mutex.Lock()
+	status.ShuttingDown = node.closing
+	if !node.closing {
+		if node.redisPool != nil {
+			conn = node.redisPool.Get()
+		}
+		if node.mongoSession != nil {
+			session = node.mongoSession.Copy()
+		}
+	}
+	node.mutex.Unlock()
+
+	if status.ShuttingDown {
+		return status
+	}
+
+	if conn != nil {
+		_, err := redis.DoWithTimeout(conn, healthCheckTimeout, "PING")
+		conn.Close()
+		status.Checks["redis"] = healthResult(err)
+	}
+
+	if session != nil {
+		session.SetSyncTimeout(healthCheckTimeout)
+		session.SetSocketTimeout(healthCheckTimeout)
+		err := session.Ping()
+		session.Close()
+		status.Checks["mongo"] = healthResult(err)
+	}
+
+	if bc, ok := node.broker.(brokerConn); ok {
+		if bc.Connected() {
+			status.Checks["broker"] = "ok"
+		} else {
+			status.Checks["broker"] = "subscription connection is down"
+		}
+	}
+
+	status.Ready = !status.ShuttingDown
+	for _, result := range status.Checks {
+		if result != "ok" {
+			status.Ready = false
+		}
+	}
+
+	return status
+}
+
+func healthResult(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
+
+// HealthHandler returns an http.Handler that responds with the node's
+// HealthStatus as JSON. The status code is 200 if the node is ready, and 503
+// if a check failed or the node is shutting down. Use it as a readiness probe:
+//
+// http.Handle("/health", node.HealthHandler())
+func (node *Node) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := node.Health()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if status.Ready {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+}
@@ -1,67 +1,33 @@
 package synk
 
-import (
-	"fmt"
-	"os"
-	"strings"
-)
+import "net/http"
 
-// RedisAddr is the address that the synk library uses. You can specify a custom
-// address by setting the SYNK_REDIS_ADDR environment variable.
-//
-// EX:
-// SYNK_REDIS_ADDR=127.0.0.2
-// SYNK_REDIS_ADDR=127.0.0.3:5555
+// RedisAddr, MongoAddr and MongoDBName hold the DefaultConfig values. The
+// package level DialRedisPool, DialRedis and DialMongo helpers, and NewNode,
+// use the ConfigFromEnv, except for any of these variables that were changed
+// from their defaults.
 //
-// If no port is specified ":6379" is used
-// If no host is specified redis's default (127.0.0.1) is used
-var RedisAddr = os.Getenv("SYNK_REDIS_ADDR")
-
-// MongoAddr is the mongodb address that the synk library uses. Defaults to
-// localhost Check mgo docs to see how ports are specified
-var MongoAddr = os.Getenv("SYNK_MONGO_ADDR")
-
-// MongoDBName is the name of the database to connect to. Defaults to "synk"
-var MongoDBName = os.Getenv("SYNK_MONGO_DB")
-
-// MongoUser and MongoPass may optionally be used to authenticate with mongod.
-// If they are both empty or unset, we will not try to authenticate. Note that
-// mongo auth credentials are tied to a mongo database, and these credentials
-// should match the db specified by "SYNK_MONGO_DB" (default = "synk")
-var mongoUser = os.Getenv("SYNK_MONGO_USER")
-var mongoPass = os.Getenv("SYNK_MONGO_PASS")
-
-// MongoLoginRequired will be set if a user or pass is specified
-var mongoLoginRequired bool
-
-// Initialize some Defaults
-func init() {
-	// redigo accepts just a host number, which causes it to bind to 127.0.0.1
-	if strings.Index(RedisAddr, ":") == -1 {
-		RedisAddr = RedisAddr + ":6379"
-	}
-
-	if MongoAddr == "" {
-		MongoAddr = "localhost"
-	}
+// Deprecated: Create a Config and pass it to NewNodeWithConfig instead.
+var (
+	RedisAddr   = DefaultConfig().RedisAddr
+	MongoAddr   = DefaultConfig().MongoAddr
+	MongoDBName = DefaultConfig().MongoDBName
+)
 
-	if MongoDBName == "" {
-		MongoDBName = "synk"
+// envConfig reads the ConfigFromEnv, and applies the deprecated package level
+// variables that were changed from their defaults.
+func envConfig() Config {
+	cfg, defaults := ConfigFromEnv(), DefaultConfig()
+	if RedisAddr != defaults.RedisAddr {
+		cfg.RedisAddr = RedisAddr
 	}
-
-	if mongoUser != "" || mongoPass != "" {
-		mongoLoginRequired = true
+	if MongoAddr != defaults.MongoAddr {
+		cfg.MongoAddr = MongoAddr
 	}
-
-	fmt.Println("Redis Address:", RedisAddr)
-	fmt.Println("Mongo Address:", MongoAddr)
-	fmt.Println("Mongo DB Name:", MongoDBName)
-
-	if mongoLoginRequired {
-		fmt.Println("Mongo User:", mongoUser)
-	} else {
-		fmt.Println("Mongo will not attempt to authenticate")
+	if MongoDBName != defaults.MongoDBName {
+		cfg.MongoDBName = MongoDBName
 	}
+	return cfg
 }
 
 // There are two ways to modify Objects.
@@ -125,6 +91,30 @@ type Client interface {
 	Publish(string, interface{}) error
 	ID() string
 	WriteToWebSocket(data []byte)
+	// Principal returns the value the Authenticator returned for the
+	// client's request, or nil if the client was not authenticated.
+	Principal() interface{}
+}
+
+// An Authenticator identifies the user behind a websocket request before the
+// request is upgraded. It may inspect cookies, the Authorization header, or
+// query parameters.
+//
+// If Authenticate returns an error, the Handler responds with 401
+// Unauthorized, and no client is created. Otherwise, the returned principal
+// (for example a user or session struct) is attached to the Client, so that
+// CustomClient callbacks can see who is talking via Client.Principal().
+type Authenticator interface {
+	Authenticate(r *http.Request) (principal interface{}, err error)
+}
+
+// AuthenticatorFunc adapts an ordinary function to the Authenticator
+// interface.
+type AuthenticatorFunc func(r *http.Request) (interface{}, error)
+
+// Authenticate calls f(r).
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (interface{}, error) {
+	return f(r)
 }
 
 // ContainerConstructor creates an Object container for a given type key. This
@@ -142,6 +132,42 @@ type CustomClient interface {
 	OnSubscribe(client Client, subKeys []string, objs []Object)
 }
 
+// A CustomClient that implements Disconnecter is told when its client
+// disconnects, for whatever reason. reason is the reason sent to the browser
+// in a close frame, or describes why the connection was lost. OnDisconnect is
+// called once, as the client's main loop exits, so it must not block. Messages
+// from the browser that were not handled yet are never passed to OnMessage.
+// OnUnsubscribe is not called for the keys the client was still subscribed to.
+type Disconnecter interface {
+	OnDisconnect(client Client, reason string)
+}
+
+// A CustomClient that implements Unsubscriber is told when its client
+// unsubscribes. subKeys are the keys in an UpdateSubscriptionMessage's Remove
+// list that the client was subscribed to, and did not add again in the same
+// message. OnUnsubscribe is called from the client's main loop, once the
+// client no longer receives messages for subKeys, so it must not block.
+type Unsubscriber interface {
+	OnUnsubscribe(client Client, subKeys []string)
+}
+
+// A SubscriptionAuthorizer decides which subscription keys a client may
+// subscribe to. It is called for each key in an UpdateSubscriptionMessage's
+// Add list, before the key is subscribed to or loaded.
+//
+// To approve the key, return it unchanged. To subscribe to a different key
+// instead, return the replacement. The browser receives the objects under the
+// replacement key, and must use that key to unsubscribe. To reject the key,
+// return an error. Rejected keys are not subscribed to or loaded, and are
+// reported to the browser in a "subscriptionError" message.
+//
+// A CustomClient that implements SubscriptionAuthorizer authorizes its own
+// subscriptions. Otherwise the node's SubscriptionAuthorizer is used, if one
+// is set. See Node.SetSubscriptionAuthorizer.
+type SubscriptionAuthorizer interface {
+	AuthorizeSubscription(client Client, subKey string) (string, error)
+}
+
 // A ClientConstructor must be supplied when implementing custom handlers.
 // The supplied function will create the custom message handler when clients
 // connect.
@@ -180,6 +206,22 @@ type AccessPoint interface {
 // The synk library provides the MongoSynk and RedisSynk types, both of which
 // satisfy Mutator. However -- Client code must provide a ContainerConstructor
 // so the Loaded Objects can be deserialized correctly.
+//
+// Mutators must not panic when the database or messaging service fails.
+// Instead they return an error that can be inspected with errors.Is. The
+// following describes the state left behind by each kind of error:
+//
+//   - ErrConflict (Create): An object with the same ID exists. Nothing was
+//     written, and no message was published.
+//   - ErrNotFound (Modify, Delete): The object does not exist. Nothing was
+//     written, and no message was published.
+//   - ErrBackendUnavailable: The database could not be reached. The write may
+//     or may not have been applied, and no message was published.
+//   - ErrPublishFailed: The write succeeded, but clients were not notified.
+//     Subscribed clients are out of sync until they resubscribe.
+//
+// In all cases, Create and Modify have already called obj.Resolve(), so the
+// object's pending diff has been applied to the object in memory.
 type Mutator interface {
 	Create(obj Object) error
 	Delete(obj Object) error
@@ -188,6 +230,39 @@ type Mutator interface {
 	Close() error
 }
 
+// A Backend decides where a Node's objects are stored. Node.CreateMutator and
+// Node.CreateLoader delegate to the Backend, so every synkClient's Loader
+// follows the same choice.
+//
+// The synk library provides MongoBackend and RedisBackend. A custom Backend
+// may use the Node's exported accessors (NewContainer, RedisPool,
+// MongoSession) to build its Mutators and Loaders.
+type Backend interface {
+	NewMutator(node *Node) Mutator
+	NewLoader(node *Node) Loader
+}
+
+// An Agent receives messages published on the channels it is subscribed to.
+// Every synkClient is an Agent. A Broker may still deliver a message after
+// RemoveAgent returns, so Receive must be safe to call once the Agent is
+// removed.
+type Agent interface {
+	Receive(channel string, data []byte) error
+}
+
+// A Broker manages the subscriptions of Agents, and delivers the messages
+// published by Mutators and Loaders to them. A Node uses a redis backed Broker
+// by default. MemoryBroker is an in-process alternative.
+type Broker interface {
+	// Update subscribes agent to the add channels, and unsubscribes it from
+	// the remove channels.
+	Update(agent Agent, add []string, remove []string)
+	// RemoveAgent unsubscribes agent from all channels.
+	RemoveAgent(agent Agent)
+	// Close stops message delivery and releases the Broker's connections.
+	Close() error
+}
+
 // A Loader is any object that can load from our database. AND publish messages
 // that may be received by nodes.
 type Loader interface {
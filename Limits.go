@@ -0,0 +1,215 @@
+package synk
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The reason sent in the close frame when a client is disconnected for
+// exceeding its limits.
+const limitReason = "limit exceeded"
+
+// A LimitAction is what happens when a client exceeds one of its ClientLimits.
+type LimitAction int
+
+const (
+	// LimitDrop ignores the offending message (or subscription keys).
+	LimitDrop LimitAction = iota
+
+	// LimitReplyError ignores the offending message, and sends the browser a
+	// protocol error. The codes are "rateLimited" and "tooManySubscriptions".
+	// See Node.RegisterMessageHandler for the format.
+	LimitReplyError
+
+	// LimitDisconnect closes the client with the ClosePolicyViolation code.
+	LimitDisconnect
+)
+
+// A Rate limits how often a client may send messages. Messages are allowed
+// at PerSecond on average, with bursts of up to Burst messages. If Burst is
+// less than one, bursts of PerSecond messages (but at least one) are allowed.
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+// ClientLimits protect the node from browsers that send too much. The zero
+// value has no limits.
+type ClientLimits struct {
+	// MaxMessageSize is the largest message, in bytes, that a client may send.
+	// Clients that send a larger message are always disconnected with the
+	// CloseMessageTooBig code. Zero means no limit.
+	MaxMessageSize int64
+
+	// MaxSubscriptions is the number of subscription keys a client may hold
+	// at once. If an updateSubscription message would exceed it, keys are
+	// added up to the limit, and the rest are refused. Zero means no limit.
+	MaxSubscriptions int
+
+	// Rate limits all the messages from a client. A zero Rate means no limit.
+	Rate Rate
+
+	// MethodRates limits the messages with each method, in addition to Rate.
+	MethodRates map[string]Rate
+
+	// Action is taken when a client exceeds Rate, MethodRates, or
+	// MaxSubscriptions.
+	Action LimitAction
+}
+
+// SetClientLimits sets the limits for clients that connect after the call.
+func (node *Node) SetClientLimits(limits ClientLimits) {
+	node.limits = limits
+}
+
+// tokenBucket implements a Rate. It is not safe for concurrent calls.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate Rate) *tokenBucket {
+	burst := float64(rate.Burst)
+	if burst < 1 {
+		burst = math.Max(1, math.Ceil(rate.PerSecond))
+	}
+	return &tokenBucket{rate: rate.PerSecond, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// ready refills the bucket, and reports if it has a token for a message now.
+func (b *tokenBucket) ready(now time.Time) bool {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	return b.tokens >= 1
+}
+
+// take uses a token. Only call take after ready returns true.
+func (b *tokenBucket) take() {
+	b.tokens--
+}
+
+// allowMessage checks a message from the browser against the client's rate
+// limits. If it is not allowed, the client's LimitAction is taken. May only
+// be called from startReadingFromWebSocket.
+func (client *synkClient) allowMessage(message interface{}) bool {
+	limits := &client.Node.limits
+	if limits.Rate.PerSecond <= 0 && len(limits.MethodRates) == 0 {
+		return true
+	}
+
+	method := "updateSubscription"
+	if msg, ok := message.(CustomMessage); ok {
+		method = msg.Method
+	}
+
+	var buckets []*tokenBucket
+	if limits.Rate.PerSecond > 0 {
+		if client.rateBucket == nil {
+			client.rateBucket = newTokenBucket(limits.Rate)
+		}
+		buckets = append(buckets, client.rateBucket)
+	}
+	if rate, ok := limits.MethodRates[method]; ok && rate.PerSecond > 0 {
+		bucket, ok := client.methodBuckets[method]
+		if !ok {
+			bucket = newTokenBucket(rate)
+			client.methodBuckets[method] = bucket
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	// Only use tokens once every bucket allows the message, so a message
+	// refused by one bucket does not use up the others.
+	now := time.Now()
+	allowed := true
+	for _, bucket := range buckets {
+		allowed = bucket.ready(now) && allowed
+	}
+	if allowed {
+		for _, bucket := range buckets {
+			bucket.take()
+		}
+		return true
+	}
+
+	client.Node.stats.rateLimited.Inc()
+	protocolErr := &protocolErrorMsg{For: method, Code: "rateLimited", Message: "too many messages"}
+	client.exceeded(protocolErr, func(bytes []byte) {
+		// A browser that is flooding us may not be reading, so never block
+		select {
+		case client.toWebSocket <- bytes:
+		default:
+			client.Node.stats.dropped.Inc()
+		}
+	})
+	return false
+}
+
+// exceeded takes the client's LimitAction. write sends the protocol error to
+// the browser. How it may do that depends on the calling goroutine.
+func (client *synkClient) exceeded(protocolErr *protocolErrorMsg, write func(bytes []byte)) {
+	switch client.Node.limits.Action {
+	case LimitReplyError:
+		bytes, err := json.Marshal(protocolErr)
+		if err != nil {
+			client.logError("Client failed to marshal protocol error", "err", err)
+			return
+		}
+		write(bytes)
+	case LimitDisconnect:
+		client.logInfo("Client exceeded its limits", "for", protocolErr.For, "code", protocolErr.Code)
+		// Close waits for the main loop, and the websocket reader, so it must
+		// not be called from either.
+		go client.closeWithReason(websocket.ClosePolicyViolation, limitReason)
+	}
+}
+
+// limitSubscriptions returns the subKeys that can be added without exceeding
+// MaxSubscriptions. remove are the keys being removed by the same message.
+// May only be called from the main loop.
+func (client *synkClient) limitSubscriptions(add, remove []string) []string {
+	max := client.Node.limits.MaxSubscriptions
+	if max <= 0 {
+		return add
+	}
+
+	count := len(client.subscriptions)
+	for _, subKey := range remove {
+		if client.subscriptions[subKey] {
+			count--
+		}
+	}
+
+	allowed := make([]string, 0, len(add))
+	var refused []string
+	for _, subKey := range add {
+		switch {
+		case client.subscriptions[subKey] && !containsString(remove, subKey):
+			allowed = append(allowed, subKey)
+		case containsString(allowed, subKey):
+		case count < max:
+			allowed = append(allowed, subKey)
+			count++
+		default:
+			refused = append(refused, subKey)
+		}
+	}
+	if len(refused) == 0 {
+		return allowed
+	}
+
+	client.Node.stats.subLimited.Add(uint64(len(refused)))
+	protocolErr := &protocolErrorMsg{
+		For:     "updateSubscription",
+		Code:    "tooManySubscriptions",
+		Message: "subscription keys refused beyond the limit",
+		SKeys:   refused,
+	}
+	client.exceeded(protocolErr, func(bytes []byte) { client.reply(bytes) })
+	return allowed
+}
@@ -0,0 +1,66 @@
+package synk
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger receives structured log events from synk. Each event has a message,
+// and a list of alternating keys and values. Synk uses the following keys:
+//
+//   - "client"   the ID of a synkClient
+//   - "subKey"   a subscription key
+//   - "objectID" the ID of a synk Object
+//   - "typeKey"  the type key of a synk Object
+//   - "method"   the method of a message from a client
+//   - "err"      an error
+//
+// A *slog.Logger satisfies Logger, so structured logs can be sent to any
+// slog.Handler with:
+//
+// node.SetLogger(slog.New(handler))
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// defaultLogger writes events to the standard library's log package in a
+// key=value format. Debug events are discarded.
+var defaultLogger Logger = stdLogger{}
+
+type stdLogger struct{}
+
+func (stdLogger) Debug(msg string, keyvals ...interface{}) {}
+
+func (stdLogger) Info(msg string, keyvals ...interface{}) {
+	log.Println(formatLog("INFO", msg, keyvals))
+}
+
+func (stdLogger) Error(msg string, keyvals ...interface{}) {
+	log.Println(formatLog("ERROR", msg, keyvals))
+}
+
+func formatLog(level, msg string, keyvals []interface{}) string {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 < len(keyvals) {
+			fmt.Fprintf(&b, " %v=%v", keyvals[i], keyvals[i+1])
+		} else {
+			fmt.Fprintf(&b, " %v=MISSING", keyvals[i])
+		}
+	}
+	return b.String()
+}
+
+// loggerOrDefault returns l, or the defaultLogger if l is nil.
+func loggerOrDefault(l Logger) Logger {
+	if l == nil {
+		return defaultLogger
+	}
+	return l
+}
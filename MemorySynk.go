@@ -0,0 +1,228 @@
+package synk
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// MemorySynk stores Objects in process memory, and publishes add, mod and rem
+// messages via a MemoryBroker. The messages are identical to those sent by
+// RedisSynk, including the "from" header sent when an object moves between
+// subscription keys.
+//
+// MemorySynk satisfies Mutator, Loader and Backend. Combined with a
+// MemoryBroker (see NewMemoryNode) a whole Node and Handler can run without
+// redis or mongodb. This is intended for tests and for prototyping.
+//
+// Objects are stored as copies. Load returns new copies, so mutating a loaded
+// object does not change the stored version until it is passed to Modify.
+type MemorySynk struct {
+	Broker *MemoryBroker
+
+	mutex   sync.RWMutex
+	objects map[string]Object          // object id -> stored copy
+	subs    map[string]map[string]bool // subscription key -> set of ids
+}
+
+// NewMemorySynk creates an empty MemorySynk that publishes via broker.
+func NewMemorySynk(broker *MemoryBroker) *MemorySynk {
+	return &MemorySynk{
+		Broker:  broker,
+		objects: make(map[string]Object),
+		subs:    make(map[string]map[string]bool),
+	}
+}
+
+// NewMutator returns the MemorySynk itself. All the node's Mutators and
+// Loaders share the same store.
+func (mem *MemorySynk) NewMutator(node *Node) Mutator {
+	return mem
+}
+
+// NewLoader returns the MemorySynk itself.
+func (mem *MemorySynk) NewLoader(node *Node) Loader {
+	return mem
+}
+
+// Create an object, and send an add message
+func (mem *MemorySynk) Create(obj Object) error {
+	typeKey := obj.TypeKey()
+	obj.TagInit(typeKey)
+
+	if initer, ok := obj.(Initializer); ok {
+		initer.OnCreate()
+	}
+
+	obj.Resolve()
+
+	subKey := obj.GetSubKey()
+	obj.TagSetSub(subKey)
+	id := obj.TagGetID()
+
+	msg := addMsg{
+		State:   obj.State(),
+		ID:      id,
+		SKey:    subKey,
+		Version: obj.Version(),
+		Type:    typeKey,
+	}
+
+	msgJSON, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("synk.MemorySynk.Create failed to convert msg to json: %s", err)
+	}
+
+	mem.mutex.Lock()
+	defer mem.mutex.Unlock()
+
+	if _, ok := mem.objects[id]; ok {
+		return &Error{Op: "MemorySynk.Create", Kind: ErrConflict, Err: fmt.Errorf("id '%s'", id)}
+	}
+
+	mem.objects[id] = obj.Copy()
+	mem.addToSub(subKey, id)
+
+	return mem.Broker.Publish(subKey, msgJSON)
+}
+
+// Modify an Object, publishing a mod message once the mutation is complete.
+// If the object changed subscription keys, also publish an add message with a
+// "from" header in the new subscription key.
+func (mem *MemorySynk) Modify(obj Object) error {
+	psk := obj.GetPrevSubKey()
+	nsk := obj.GetSubKey()
+	id := obj.TagGetID()
+	simple := psk == nsk
+
+	msg := modMsg{
+		Diff:    obj.Resolve(),
+		ID:      id,
+		SKey:    psk,
+		Version: obj.Version(),
+	}
+
+	if !simple {
+		msg.NSKey = nsk
+		obj.TagSetSub(nsk)
+	}
+
+	msgJSON, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("synk.MemorySynk.Modify failed to convert modMsg to json: %s", err)
+	}
+
+	var addJSON []byte
+	if !simple {
+		amsg := addMsg{
+			State:   obj.State(),
+			ID:      id,
+			SKey:    nsk,
+			PSKey:   psk,
+			Version: obj.Version(),
+			Type:    obj.TypeKey(),
+		}
+		addJSON, err = json.Marshal(amsg)
+		if err != nil {
+			return fmt.Errorf("synk.MemorySynk.Modify failed to convert addMsg to json: %s", err)
+		}
+		// See redisModObject for an explanation of the "from" header
+		addJSON = []byte("from " + psk + string(addJSON))
+	}
+
+	mem.mutex.Lock()
+	defer mem.mutex.Unlock()
+
+	if _, ok := mem.objects[id]; !ok {
+		return &Error{Op: "MemorySynk.Modify", Kind: ErrNotFound, Err: fmt.Errorf("id '%s'", id)}
+	}
+
+	mem.objects[id] = obj.Copy()
+
+	if simple {
+		return mem.Broker.Publish(psk, msgJSON)
+	}
+
+	mem.removeFromSub(psk, id)
+	mem.addToSub(nsk, id)
+
+	if err = mem.Broker.Publish(psk, msgJSON); err != nil {
+		return err
+	}
+	return mem.Broker.Publish(nsk, addJSON)
+}
+
+// Delete an object, publishing a rem message on completion. If the object is
+// not in the store, return an ErrNotFound error.
+func (mem *MemorySynk) Delete(obj Object) error {
+	// Use the Previous subscription key. See MongoSynk.Delete
+	msg := remMsg{
+		SKey: obj.GetPrevSubKey(),
+		ID:   obj.TagGetID(),
+		Type: obj.TypeKey(),
+	}
+
+	msgJSON, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("synk.MemorySynk.Delete failed to convert msg to json: %s", err)
+	}
+
+	mem.mutex.Lock()
+	defer mem.mutex.Unlock()
+
+	stored, ok := mem.objects[msg.ID]
+	if !ok {
+		return &Error{Op: "MemorySynk.Delete", Kind: ErrNotFound, Err: fmt.Errorf("id '%s'", msg.ID)}
+	}
+
+	mem.removeFromSub(stored.GetSubKey(), msg.ID)
+	delete(mem.objects, msg.ID)
+
+	return mem.Broker.Publish(msg.SKey, msgJSON)
+}
+
+// Load retrieves copies of all objects in the given subscription keys.
+func (mem *MemorySynk) Load(subKeys []string) ([]Object, error) {
+	mem.mutex.RLock()
+	defer mem.mutex.RUnlock()
+
+	results := make([]Object, 0)
+	for _, subKey := range subKeys {
+		for id := range mem.subs[subKey] {
+			results = append(results, mem.objects[id].Copy())
+		}
+	}
+	return results, nil
+}
+
+// Publish a message via the Broker. If the message is a []byte, publish it
+// directly. Otherwise Marshal it to JSON.
+func (mem *MemorySynk) Publish(channel string, msg interface{}) error {
+	return mem.Broker.Publish(channel, msg)
+}
+
+// Close does nothing. The MemorySynk is shared by all of a node's Mutators and
+// Loaders, so it is never closed by them.
+func (mem *MemorySynk) Close() error {
+	return nil
+}
+
+// must be called while holding mem.mutex
+func (mem *MemorySynk) addToSub(subKey, id string) {
+	ids, ok := mem.subs[subKey]
+	if !ok {
+		ids = make(map[string]bool)
+		mem.subs[subKey] = ids
+	}
+	ids[id] = true
+}
+
+// must be called while holding mem.mutex
+func (mem *MemorySynk) removeFromSub(subKey, id string) {
+	if ids, ok := mem.subs[subKey]; ok {
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(mem.subs, subKey)
+		}
+	}
+}
@@ -51,3 +51,12 @@ func MessageFromBytes(raw []byte) (interface{}, error) {
 		return CustomMessage{Method: mm.Method, Data: raw}, nil
 	}
 }
+
+// marshalMessage returns msg if it is a []byte. Otherwise it returns msg
+// marshaled to JSON.
+func marshalMessage(msg interface{}) ([]byte, error) {
+	if raw, ok := msg.([]byte); ok {
+		return raw, nil
+	}
+	return json.Marshal(msg)
+}
@@ -0,0 +1,172 @@
+package synk
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+var clientType = reflect.TypeOf((*Client)(nil)).Elem()
+
+// typedHandler is a handler registered with RegisterMessageHandler
+type typedHandler struct {
+	fn       reflect.Value
+	reqType  reflect.Type // the type that the pointer argument points to
+	required []string     // json names of required fields
+}
+
+// RegisterMessageHandler adds a handler for messages from the browser with the
+// given method. handler must be a function with the signature:
+//
+// func(client synk.Client, req *T)
+//
+// where T is any type that the message can be unmarshaled into with
+// encoding/json. The whole message (including the "method" field) is
+// unmarshaled into a new T, and passed to the handler. Handlers are called
+// from the client's main loop, like CustomClient.OnMessage, so they must not
+// block.
+//
+// If T is a struct, fields tagged with `synk:"required"` must be present in
+// the message, and must not be null.
+//
+// When a message cannot be handled, the browser receives a protocol error
+// such as:
+//
+// {"method":"protocolError","for":"move","code":"missingField","message":"..."}
+//
+// The codes are "decodeFailed", "missingField", and "unknownMethod". Once a
+// node has at least one message handler, messages for methods without a
+// message handler or RPC handler get an "unknownMethod" error, and
+// CustomClient.OnMessage is no longer called.
+//
+// Panic if handler has the wrong signature, or the method is already
+// registered.
+func (node *Node) RegisterMessageHandler(method string, handler interface{}) {
+	if method == "" || method == "updateSubscription" {
+		panic("synk.Node cannot register a message handler for reserved method " + method)
+	}
+	if _, ok := node.rpcHandlers[method]; ok {
+		panic("synk.Node cannot register a message handler for " + method + ", which has an RPC handler")
+	}
+	if _, ok := node.msgHandlers[method]; ok {
+		panic("synk.Node cannot register an additional message handler for " + method)
+	}
+
+	fn := reflect.ValueOf(handler)
+	t := fn.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 2 || t.NumOut() != 0 ||
+		t.In(0) != clientType || t.In(1).Kind() != reflect.Ptr {
+		panic(fmt.Sprintf("synk.Node message handler for %s must be a func(synk.Client, *T), not %s", method, t))
+	}
+
+	node.msgHandlers[method] = &typedHandler{
+		fn:       fn,
+		reqType:  t.In(1).Elem(),
+		required: requiredFields(t.In(1).Elem()),
+	}
+}
+
+// requiredFields returns the json names of t's fields with a synk:"required"
+// tag.
+func requiredFields(t reflect.Type) []string {
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Tag.Get("synk") != "required" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// handle decodes data and calls the handler, or returns a protocolErrorMsg.
+func (h *typedHandler) handle(client Client, method string, data []byte) *protocolErrorMsg {
+	req := reflect.New(h.reqType)
+	if err := json.Unmarshal(data, req.Interface()); err != nil {
+		return &protocolErrorMsg{For: method, Code: "decodeFailed", Message: err.Error()}
+	}
+
+	if len(h.required) > 0 {
+		var fields map[string]json.RawMessage
+		json.Unmarshal(data, &fields)
+		for _, name := range h.required {
+			if !hasField(fields, name) {
+				return &protocolErrorMsg{For: method, Code: "missingField", Message: "missing required field " + name}
+			}
+		}
+	}
+
+	h.fn.Call([]reflect.Value{reflect.ValueOf(client), req})
+	return nil
+}
+
+// hasField reports if fields has a non-null value for name. Like
+// encoding/json, keys are matched case insensitively.
+func hasField(fields map[string]json.RawMessage, name string) bool {
+	value, ok := fields[name]
+	if !ok {
+		for key, v := range fields {
+			if strings.EqualFold(key, name) {
+				value, ok = v, true
+				break
+			}
+		}
+	}
+	return ok && string(value) != "null"
+}
+
+// protocolErrorMsg tells the browser that a message could not be handled
+type protocolErrorMsg struct {
+	Method  protocolErrorMethod `json:"method"`
+	For     string              `json:"for"`
+	Code    string              `json:"code"`
+	Message string              `json:"message"`
+	SKeys   []string            `json:"sKeys,omitempty"`
+}
+
+type protocolErrorMethod struct{}
+
+func (m protocolErrorMethod) MarshalJSON() ([]byte, error) {
+	return []byte("\"protocolError\""), nil
+}
+
+// handleCustomMessage passes msg to an RPC handler, a message handler, or the
+// CustomClient. May only be called from the main loop.
+func (client *synkClient) handleCustomMessage(msg CustomMessage) error {
+	if handler, ok := client.Node.rpcHandlers[msg.Method]; ok {
+		client.call(handler, msg)
+		return nil
+	}
+
+	var protocolErr *protocolErrorMsg
+	if handler, ok := client.Node.msgHandlers[msg.Method]; ok {
+		protocolErr = handler.handle(client, msg.Method, msg.Data)
+	} else if len(client.Node.msgHandlers) > 0 {
+		protocolErr = &protocolErrorMsg{For: msg.Method, Code: "unknownMethod", Message: "no handler for " + msg.Method}
+	} else if client.custom != nil {
+		client.custom.OnMessage(client, msg.Method, msg.Data)
+		return nil
+	} else {
+		return fmt.Errorf("Client.handleMessages does not handle %T", msg)
+	}
+
+	if protocolErr != nil {
+		client.logInfo("Client sent a message that could not be handled",
+			"method", msg.Method, "err", protocolErr.Message)
+		bytes, err := json.Marshal(protocolErr)
+		if err != nil {
+			return err
+		}
+		return client.reply(bytes)
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+package synk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBuckets are the histogram buckets (in seconds) used for synk's
+// latency metrics.
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// Metrics is a registry of counters, gauges and histograms. Every Node has a
+// Metrics registry that synk uses to report on clients, subscriptions,
+// mutations and publish latency. Applications may register their own
+// metrics in the same registry.
+//
+// Metrics is an http.Handler that serves the current values in the Prometheus
+// text exposition format.
+//
+// All methods are safe for concurrent calls. All methods are also safe to
+// call on a nil *Metrics, and on the nil metrics returned by a nil *Metrics.
+// In that case they do nothing.
+type Metrics struct {
+	mutex    sync.Mutex
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	name     string
+	help     string
+	kind     string // "counter", "gauge" or "histogram"
+	buckets  []float64
+	children map[string]metric // rendered labels -> metric
+}
+
+type metric interface {
+	write(w io.Writer, name, labels string)
+}
+
+// NewMetrics creates an empty Metrics registry.
+func NewMetrics() *Metrics {
+	return &Metrics{families: make(map[string]*metricFamily)}
+}
+
+// Counter returns the counter with the supplied name and label values,
+// creating it if needed. labels alternate between label names and values.
+//
+// Panic if name was already registered as a different kind of metric.
+func (m *Metrics) Counter(name, help string, labels ...string) *Counter {
+	if m == nil {
+		return nil
+	}
+	return m.get(name, help, "counter", nil, labels).(*Counter)
+}
+
+// Gauge returns the gauge with the supplied name and label values, creating
+// it if needed. labels alternate between label names and values.
+//
+// Panic if name was already registered as a different kind of metric.
+func (m *Metrics) Gauge(name, help string, labels ...string) *Gauge {
+	if m == nil {
+		return nil
+	}
+	return m.get(name, help, "gauge", nil, labels).(*Gauge)
+}
+
+// Histogram returns the histogram with the supplied name and label values,
+// creating it if needed. buckets are the upper bounds of the histogram
+// buckets, in increasing order. They are only used when the name is first
+// registered. labels alternate between label names and values.
+//
+// Panic if name was already registered as a different kind of metric.
+func (m *Metrics) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if m == nil {
+		return nil
+	}
+	return m.get(name, help, "histogram", buckets, labels).(*Histogram)
+}
+
+func (m *Metrics) get(name, help, kind string, buckets []float64, labels []string) metric {
+	key := renderLabels(labels)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	family, ok := m.families[name]
+	if !ok {
+		family = &metricFamily{
+			name:     name,
+			help:     help,
+			kind:     kind,
+			buckets:  buckets,
+			children: make(map[string]metric),
+		}
+		m.families[name] = family
+	} else if family.kind != kind {
+		panic(fmt.Sprintf("synk.Metrics: %s is a %s, not a %s", name, family.kind, kind))
+	}
+
+	child, ok := family.children[key]
+	if !ok {
+		switch kind {
+		case "counter":
+			child = &Counter{}
+		case "gauge":
+			child = &Gauge{}
+		case "histogram":
+			child = &Histogram{buckets: family.buckets, counts: make([]uint64, len(family.buckets))}
+		}
+		family.children[key] = child
+	}
+	return child
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	if m == nil {
+		return 0, nil
+	}
+
+	var buf bytes.Buffer
+
+	m.mutex.Lock()
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := m.families[name]
+		keys := make([]string, 0, len(family.children))
+		for key := range family.children {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		fmt.Fprintf(&buf, "# HELP %s %s\n", name, escapeHelp(family.help))
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", name, family.kind)
+		for _, key := range keys {
+			family.children[key].write(&buf, name, key)
+		}
+	}
+	m.mutex.Unlock()
+
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// Counter is a metric that only goes up.
+type Counter struct {
+	value uint64
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add n to the counter.
+func (c *Counter) Add(n uint64) {
+	if c == nil {
+		return
+	}
+	atomic.AddUint64(&c.value, n)
+}
+
+// Value returns the current count.
+func (c *Counter) Value() uint64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) write(w io.Writer, name, labels string) {
+	fmt.Fprintf(w, "%s%s %d\n", name, labels, c.Value())
+}
+
+// Gauge is a metric that can go up and down.
+type Gauge struct {
+	value int64
+}
+
+// Inc adds one to the gauge.
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+// Dec subtracts one from the gauge.
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+// Add n to the gauge. n may be negative.
+func (g *Gauge) Add(n int64) {
+	if g == nil {
+		return
+	}
+	atomic.AddInt64(&g.value, n)
+}
+
+// Set the gauge to n.
+func (g *Gauge) Set(n int64) {
+	if g == nil {
+		return
+	}
+	atomic.StoreInt64(&g.value, n)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() int64 {
+	if g == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&g.value)
+}
+
+func (g *Gauge) write(w io.Writer, name, labels string) {
+	fmt.Fprintf(w, "%s%s %d\n", name, labels, g.Value())
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	mutex   sync.Mutex
+	buckets []float64
+	counts  []uint64 // not cumulative
+	count   uint64
+	sum     float64
+}
+
+// Observe adds a single observation to the histogram.
+func (h *Histogram) Observe(v float64) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// ObserveSince observes the number of seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	if h == nil {
+		return 0
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.count
+}
+
+func (h *Histogram) write(w io.Writer, name, labels string) {
+	h.mutex.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	count, sum := h.count, h.sum
+	h.mutex.Unlock()
+
+	var cumulative uint64
+	for i, upper := range h.buckets {
+		cumulative += counts[i]
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", formatFloat(upper)), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", "+Inf"), count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, count)
+}
+
+// renderLabels converts alternating names and values to the Prometheus
+// {name="value",...} format. Return "" if there are no labels.
+func renderLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, labels[i]+`="`+escapeLabel(labels[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// withLabel adds a label to already rendered labels
+func withLabel(labels, name, value string) string {
+	label := name + `="` + escapeLabel(value) + `"`
+	if labels == "" {
+		return "{" + label + "}"
+	}
+	return labels[:len(labels)-1] + "," + label + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func escapeHelp(help string) string {
+	help = strings.Replace(help, `\`, `\\`, -1)
+	return strings.Replace(help, "\n", `\n`, -1)
+}
+
+// observeMutation records the outcome and duration of a Mutator operation.
+func (m *Metrics) observeMutation(backend, op string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.Histogram("synk_mutation_seconds", "Duration of Mutator operations.",
+		DefaultBuckets, "backend", backend, "op", op).ObserveSince(start)
+	m.Counter("synk_mutations_total", "Mutator operations.",
+		"backend", backend, "op", op).Inc()
+	if err != nil {
+		m.Counter("synk_mutation_errors_total", "Mutator operations that returned an error.",
+			"backend", backend, "op", op).Inc()
+	}
+}
+
+// observePublish records the latency of publishing a message to clients.
+func (m *Metrics) observePublish(backend string, start time.Time) {
+	m.Histogram("synk_publish_seconds", "Latency of publishing messages to clients.",
+		DefaultBuckets, "backend", backend).ObserveSince(start)
+}
+
+// nodeMetrics are the metrics that synk updates on hot paths. They are looked
+// up once when the node is created.
+type nodeMetrics struct {
+	connections   *Counter
+	upgradeErrors *Counter
+	authFailures  *Counter
+	clients       *Gauge
+	subscriptions *Gauge
+	subRejected   *Counter
+	loadSeconds   *Histogram
+	received      *Counter
+	bufferFull    *Counter
+
+	dropped         *Counter
+	slowDisconnects *Counter
+	slowResyncs     *Counter
+	slowCoalesced   *Counter
+
+	sessionsResumed *Counter
+	resumeFailures  *Counter
+
+	rateLimited   *Counter
+	subLimited    *Counter
+	oversizedMsgs *Counter
+
+	kicked           *Counter
+	broadcasts       *Counter
+	broadcastDropped *Counter
+}
+
+func newNodeMetrics(m *Metrics) nodeMetrics {
+	return nodeMetrics{
+		connections:   m.Counter("synk_connections_total", "Websocket connections accepted by Handlers."),
+		upgradeErrors: m.Counter("synk_upgrade_errors_total", "Requests that could not be upgraded to websockets."),
+		authFailures:  m.Counter("synk_auth_failures_total", "Requests rejected by the Authenticator."),
+		clients:       m.Gauge("synk_clients", "Currently connected clients."),
+		subscriptions: m.Gauge("synk_subscriptions", "Subscription keys held by connected clients."),
+		subRejected:   m.Counter("synk_subscriptions_rejected_total", "Subscription keys rejected by a SubscriptionAuthorizer."),
+		loadSeconds:   m.Histogram("synk_load_seconds", "Duration of Loader.Load when clients subscribe.", DefaultBuckets),
+		received:      m.Counter("synk_received_messages_total", "Messages received by clients from the Broker."),
+		bufferFull:    m.Counter("synk_client_buffer_full_total", "Times a client's outgoing buffer was full."),
+
+		dropped:         m.Counter("synk_dropped_messages_total", "Messages to clients dropped by the BackpressurePolicy."),
+		slowDisconnects: m.Counter("synk_slow_client_disconnects_total", "Clients disconnected because they could not keep up."),
+		slowResyncs:     m.Counter("synk_slow_client_resyncs_total", "Subscription keys resynced because a client's buffer was full."),
+		slowCoalesced:   m.Counter("synk_slow_client_coalesced_total", "Mod messages merged into a queued mod for the same object."),
+
+		sessionsResumed: m.Counter("synk_sessions_resumed_total", "Sessions resumed by reconnecting browsers."),
+		resumeFailures:  m.Counter("synk_session_resume_failures_total", "Requests to resume a session that could not be resumed."),
+
+		rateLimited:   m.Counter("synk_client_rate_limited_total", "Messages from clients that exceeded their rate limits."),
+		subLimited:    m.Counter("synk_client_subscription_limited_total", "Subscription keys refused because a client reached MaxSubscriptions."),
+		oversizedMsgs: m.Counter("synk_client_oversized_messages_total", "Clients disconnected for sending a message larger than MaxMessageSize."),
+
+		kicked:           m.Counter("synk_clients_kicked_total", "Clients disconnected by Node.Disconnect."),
+		broadcasts:       m.Counter("synk_broadcasts_total", "Messages broadcast to every client on the node."),
+		broadcastDropped: m.Counter("synk_broadcast_dropped_total", "Broadcast messages dropped because a client's buffer was full."),
+	}
+}
@@ -2,7 +2,7 @@ package synk
 
 import (
 	"encoding/json"
-	"log"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 	"gopkg.in/mgo.v2/bson"
@@ -10,13 +10,6 @@ import (
 	mgo "gopkg.in/mgo.v2"
 )
 
-func epanic(reason string, err error) {
-	if err == nil {
-		return
-	}
-	log.Panicln(reason, err.Error())
-}
-
 // MongoSynk interfaces with the mongodb database
 //
 // Important: The Collection must be a unique session.
@@ -24,6 +17,8 @@ type MongoSynk struct {
 	Coll      *mgo.Collection
 	Creator   ContainerConstructor
 	RedisPool *redis.Pool
+	Logger    Logger   // Optional. If nil, log with the standard library
+	Metrics   *Metrics // Optional. If nil, metrics are not recorded
 }
 
 ////////////////////////////////////////////////////////////////
@@ -44,25 +39,28 @@ func (ms *MongoSynk) Load(sKeys []string) ([]Object, error) {
 	var err error
 
 	err = ms.Coll.Find(bson.M{"sub": bson.M{"$in": sKeys}}).All(&rawResults)
-	epanic("MongoSynk.GetObjects: error with .All mongo query", err)
+	if err != nil {
+		return nil, &Error{Op: "MongoSynk.Load", Kind: ErrBackendUnavailable, Err: err}
+	}
 
+	logger := loggerOrDefault(ms.Logger)
 	results = make([]Object, 0, len(rawResults))
 	for _, raw := range rawResults {
 
 		temp := typeOnly{}
 		err = raw.Unmarshal(&temp)
 		if err != nil {
-			log.Println("MongoSynk.GetObjects failed to get ID from raw mongo object:", err.Error())
+			logger.Error("MongoSynk.Load failed to get type from raw mongo object", "err", err)
 			continue
 		}
 		container := ms.Creator(temp.Type)
 		if container == nil {
-			log.Println("MongoSynk.GetObjects found no container for type:", temp.Type)
+			logger.Error("MongoSynk.Load found no container for type", "typeKey", temp.Type)
 			continue
 		}
 		err = raw.Unmarshal(container)
 		if err != nil {
-			log.Println("MongoSynk.GetObjects faild to marshal object into container", temp.Type)
+			logger.Error("MongoSynk.Load failed to unmarshal object into container", "typeKey", temp.Type, "err", err)
 			continue
 		}
 		results = append(results, container)
@@ -76,8 +74,11 @@ func (ms *MongoSynk) Load(sKeys []string) ([]Object, error) {
 //
 ////////////////////////////////////////////////////////////////
 
-// Create an object, and send an add message
-func (ms *MongoSynk) Create(obj Object) error {
+// Create an object, and send an add message. If an object with the same ID
+// already exists, return an ErrConflict error.
+func (ms *MongoSynk) Create(obj Object) (err error) {
+	defer func(start time.Time) { ms.Metrics.observeMutation("mongo", "create", start, err) }(time.Now())
+
 	typeKey := obj.TypeKey()
 
 	// This will set the object's ID and Type, so that the correct value will
@@ -105,17 +106,20 @@ func (ms *MongoSynk) Create(obj Object) error {
 		Type:    typeKey,
 	}
 
-	err := ms.Coll.Insert(obj)
-	epanic("Failed to create new object in Mongodb", err)
+	if err := ms.Coll.Insert(obj); err != nil {
+		return mongoError("MongoSynk.Create", err)
+	}
 
-	err = ms.send(msg)
-	epanic("Failed to send addMsg", err)
+	if err := ms.send(msg); err != nil {
+		return &Error{Op: "MongoSynk.Create", Kind: ErrPublishFailed, Err: err}
+	}
 	return nil
 }
 
 // Modify a MongoObject, publishing a mod message once the mutation is complete.
-func (ms *MongoSynk) Modify(obj Object) error {
-	var err error
+// If the object is not in the collection, return an ErrNotFound error.
+func (ms *MongoSynk) Modify(obj Object) (err error) {
+	defer func(start time.Time) { ms.Metrics.observeMutation("mongo", "modify", start, err) }(time.Now())
 
 	nsk := obj.GetSubKey()
 	psk := obj.GetPrevSubKey()
@@ -138,10 +142,12 @@ func (ms *MongoSynk) Modify(obj Object) error {
 	}
 
 	if simple {
-		err = ms.Coll.UpdateId(id, obj)
-		epanic("Mongosynk.Modify failed to insert object", err)
-		err = ms.sendMod(msg)
-		epanic("MongoSynk.Modify failed to send message", err)
+		if err = ms.Coll.UpdateId(id, obj); err != nil {
+			return mongoError("MongoSynk.Modify", err)
+		}
+		if err = ms.sendMod(msg); err != nil {
+			return &Error{Op: "MongoSynk.Modify", Kind: ErrPublishFailed, Err: err}
+		}
 		return nil
 	}
 
@@ -162,18 +168,23 @@ func (ms *MongoSynk) Modify(obj Object) error {
 
 	obj.TagSetSub(nsk)
 
-	err = ms.Coll.UpdateId(id, obj)
-	epanic("MongoSynk.Modify failed to insert on a non-simple Modify", err)
-	err = ms.sendMod(msg)
-	epanic("MongoSynk.Modify failed to send mod message on a non-simple Modify", err)
-	err = ms.sendAddFrom(amsg, psk)
-	epanic("MongoSynk.Modify failed to send add message on a non-simple Modify", err)
+	if err = ms.Coll.UpdateId(id, obj); err != nil {
+		return mongoError("MongoSynk.Modify", err)
+	}
+	if err = ms.sendMod(msg); err != nil {
+		return &Error{Op: "MongoSynk.Modify", Kind: ErrPublishFailed, Err: err}
+	}
+	if err = ms.sendAddFrom(amsg, psk); err != nil {
+		return &Error{Op: "MongoSynk.Modify", Kind: ErrPublishFailed, Err: err}
+	}
 
 	return nil
 }
 
-// Delete an object from the db, publishing a rem message on completion.
-func (ms *MongoSynk) Delete(obj Object) error {
+// Delete an object from the db, publishing a rem message on completion. If the
+// object is not in the collection, return an ErrNotFound error.
+func (ms *MongoSynk) Delete(obj Object) (err error) {
+	defer func(start time.Time) { ms.Metrics.observeMutation("mongo", "delete", start, err) }(time.Now())
 
 	// Note that we are using the Previous subscription key. If we are deleting
 	// an object that was moving to another subscription, but the move was not yet
@@ -184,10 +195,12 @@ func (ms *MongoSynk) Delete(obj Object) error {
 		Type: obj.TypeKey(),
 	}
 
-	err := ms.Coll.RemoveId(obj.TagGetID())
-	epanic("MongoSynk.Delete failed to Remove an object", err)
-	err = ms.sendRem(msg)
-	epanic("MongoSynk.Delete failed to send rem message", err)
+	if err := ms.Coll.RemoveId(obj.TagGetID()); err != nil {
+		return mongoError("MongoSynk.Delete", err)
+	}
+	if err := ms.sendRem(msg); err != nil {
+		return &Error{Op: "MongoSynk.Delete", Kind: ErrPublishFailed, Err: err}
+	}
 
 	return nil
 }
@@ -204,23 +217,17 @@ func (ms *MongoSynk) Close() error {
 // Publish a message. If the message is a []byte, publish it directly. Otherwise
 // Marshal it to JSON.
 func (ms *MongoSynk) Publish(channel string, msg interface{}) error {
+	defer ms.Metrics.observePublish("mongo", time.Now())
 	conn := ms.RedisPool.Get()
 	defer conn.Close()
 
-	var bytes []byte
-	var err error
-
-	if msg, ok := msg.([]byte); ok {
-		bytes = msg
-	} else {
-		bytes, err = json.Marshal(msg)
-		if err != nil {
-			return err
-		}
+	bytes, err := marshalMessage(msg)
+	if err != nil {
+		return err
 	}
 
 	_, err = conn.Do("PUBLISH", channel, bytes)
-	return err
+	return redisError("MongoSynk.Publish", err)
 }
 
 ////////////////////////////////////////////////////////////////
@@ -230,6 +237,7 @@ func (ms *MongoSynk) Publish(channel string, msg interface{}) error {
 ////////////////////////////////////////////////////////////////
 
 func (ms *MongoSynk) send(msg addMsg) error {
+	defer ms.Metrics.observePublish("mongo", time.Now())
 	bytes, err := json.Marshal(msg)
 	if err != nil {
 		return err
@@ -241,6 +249,7 @@ func (ms *MongoSynk) send(msg addMsg) error {
 }
 
 func (ms *MongoSynk) sendMod(msg modMsg) error {
+	defer ms.Metrics.observePublish("mongo", time.Now())
 	bytes, err := json.Marshal(msg)
 	if err != nil {
 		return err
@@ -254,6 +263,7 @@ func (ms *MongoSynk) sendMod(msg modMsg) error {
 }
 
 func (ms *MongoSynk) sendAddFrom(msg addMsg, from string) error {
+	defer ms.Metrics.observePublish("mongo", time.Now())
 	bytes, err := json.Marshal(msg)
 	if err != nil {
 		return err
@@ -267,6 +277,7 @@ func (ms *MongoSynk) sendAddFrom(msg addMsg, from string) error {
 }
 
 func (ms *MongoSynk) sendRem(msg remMsg) error {
+	defer ms.Metrics.observePublish("mongo", time.Now())
 	bytes, err := json.Marshal(msg)
 	if err != nil {
 		return err
@@ -343,3 +354,71 @@ type remMethod struct{}
 func (m remMethod) MarshalJSON() ([]byte, error) {
 	return []byte("\"rem\""), nil
 }
+
+// resyncMsg tells clients that messages for the listed subscription keys may
+// have been lost. The client should discard the objects in those keys, and
+// resubscribe to them.
+type resyncMsg struct {
+	Method resyncMethod `json:"method"`
+	SKeys  []string     `json:"sKeys"`
+}
+
+type resyncMethod struct{}
+
+func (m resyncMethod) MarshalJSON() ([]byte, error) {
+	return []byte("\"resync\""), nil
+}
+
+// addBatchMsg contains the add messages for several objects in the same
+// subscription key. See Node.SetLoadBatchSize.
+type addBatchMsg struct {
+	Method addBatchMethod    `json:"method"`
+	SKey   string            `json:"sKey"`
+	Objs   []json.RawMessage `json:"objs"`
+}
+
+type addBatchMethod struct{}
+
+func (m addBatchMethod) MarshalJSON() ([]byte, error) {
+	return []byte("\"addBatch\""), nil
+}
+
+// subscribedMsg tells clients that every object in a subscription key has
+// been sent.
+type subscribedMsg struct {
+	Method subscribedMethod `json:"method"`
+	SKey   string           `json:"sKey"`
+}
+
+type subscribedMethod struct{}
+
+func (m subscribedMethod) MarshalJSON() ([]byte, error) {
+	return []byte("\"subscribed\""), nil
+}
+
+// sessionMsg is the first message sent to clients when session resume is
+// enabled. See Node.EnableSessionResume.
+type sessionMsg struct {
+	Method  sessionMethod `json:"method"`
+	Token   string        `json:"token"`
+	Resumed bool          `json:"resumed"`
+}
+
+type sessionMethod struct{}
+
+func (m sessionMethod) MarshalJSON() ([]byte, error) {
+	return []byte("\"session\""), nil
+}
+
+// subscriptionErrorMsg tells clients that a SubscriptionAuthorizer rejected
+// the listed subscription keys. The keys were not subscribed to.
+type subscriptionErrorMsg struct {
+	Method subscriptionErrorMethod `json:"method"`
+	SKeys  []string                `json:"sKeys"`
+}
+
+type subscriptionErrorMethod struct{}
+
+func (m subscriptionErrorMethod) MarshalJSON() ([]byte, error) {
+	return []byte("\"subscriptionError\""), nil
+}
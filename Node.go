@@ -1,41 +1,159 @@
 package synk
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"sync"
 	"time"
 
-	"github.com/CharlesHolbrow/pubsub"
 	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/websocket"
 	"gopkg.in/mgo.v2"
 )
 
 // Node is the main interface for interacting with a synk server. Every golang
 // application in a sync project should create one Node instance.
 //
-// Exported methods must be safe for concurrent calls.
+// Exported methods must be safe for concurrent calls, except for the methods
+// that configure the Node: the Set, Register and Enable methods. Call those
+// before serving clients.
 type Node struct {
+	config       Config
 	mongoSession *mgo.Session
 	redisPool    *redis.Pool
-	redisAgents  *pubsub.RedisAgents
+	broker       Broker
+	backend      Backend
 	newContainer ContainerConstructor
 	newClient    ClientConstructor
+	namedClients map[string]ClientConstructor
+	auth         Authenticator
+	subAuth      SubscriptionAuthorizer
+	backpressure BackpressurePolicy
+	resumeGrace  time.Duration
+	resumeLimit  int
+	batchSize    int
+	rpcHandlers  map[string]RPCHandler
+	rpcTimeout   time.Duration
+	msgHandlers  map[string]*typedHandler
+	limits       ClientLimits
+	onDisconnect DisconnectHandler
+	agent        *nodeAgent
+	logger       Logger
+	metrics      *Metrics
+	stats        nodeMetrics
+
+	// clients is shared by all Handlers serving the node
+	clients *ClientPool
+
+	// clientsWG tracks every websocket connection being served by a Handler.
+	// closing is set when Shutdown is called. Once it is set, no more calls
+	// to clientsWG.Add may be made. Both are guarded by mutex.
+	mutex     sync.Mutex
+	clientsWG sync.WaitGroup
+	closing   bool
+
+	// sessions maps resume tokens to sessions. See EnableSessionResume
+	sessionMutex sync.Mutex
+	sessions     map[string]*session
 }
 
-// NewNode creates new a *Node with the default connections.
+// NewNode creates new a *Node with the default connections. The connection
+// settings are read from the environment. See ConfigFromEnv.
 //
 // Objects created with NewNode are not ready for use. The NewContainer and
 // NewClient members must be set or the CreateMutator/CreateLoader methods will
 // fail.
+//
+// Panic if we cannot connect to redis or mongodb.
 func NewNode() *Node {
-	return &Node{
-		mongoSession: DialMongo(),
-		redisPool:    DialRedisPool(),
-		redisAgents:  pubsub.NewRedisAgents(DialRedis()),
+	node, err := NewNodeWithConfig(envConfig())
+	if err != nil {
+		panic(err.Error())
+	}
+	return node
+}
+
+// NewNodeWithConfig creates a new *Node, connecting to the services described
+// by cfg. Like NewNode, the returned Node is not ready for use until the
+// container and client constructors are registered.
+//
+// If cfg.MongoAddr is empty, the node will not connect to mongodb. If
+// cfg.Backend is nil, a MongoBackend is used when mongodb is configured, and a
+// RedisBackend is used otherwise.
+//
+// If we cannot connect to redis or mongodb, return an ErrBackendUnavailable
+// error.
+func NewNodeWithConfig(cfg Config) (*Node, error) {
+	var session *mgo.Session
+	var err error
+
+	if cfg.MongoAddr != "" {
+		if session, err = cfg.DialMongo(); err != nil {
+			return nil, err
+		}
+	}
+
+	broker, err := NewRedisBroker(cfg)
+	if err != nil {
+		if session != nil {
+			session.Close()
+		}
+		return nil, err
 	}
+
+	node := newNode(cfg, broker, cfg.Backend)
+	node.redisPool = cfg.DialRedisPool()
+	node.mongoSession = session
+
+	if node.backend == nil {
+		if node.mongoSession != nil {
+			node.backend = MongoBackend{}
+		} else {
+			node.backend = RedisBackend{}
+		}
+	}
+
+	return node, nil
 }
 
-// CreateMutator returns a ready to use Mutator. The Mutator must be .Closed()
-// when it is no longer needed.
+// NewMemoryNode creates a *Node that stores objects in memory and delivers
+// messages to clients with a MemoryBroker. It does not connect to redis or
+// mongodb, which makes it suitable for tests.
+//
+// Like NewNode, the returned Node is not ready for use until the container
+// and client constructors are registered.
+func NewMemoryNode() *Node {
+	broker := NewMemoryBroker()
+	return newNode(Config{}, broker, NewMemorySynk(broker))
+}
+
+func newNode(cfg Config, broker Broker, backend Backend) *Node {
+	node := &Node{
+		config:       cfg,
+		broker:       broker,
+		backend:      backend,
+		namedClients: make(map[string]ClientConstructor),
+		sessions:     make(map[string]*session),
+		rpcHandlers:  make(map[string]RPCHandler),
+		msgHandlers:  make(map[string]*typedHandler),
+		clients:      newClientPool(),
+		logger:       loggerOrDefault(cfg.Logger),
+		metrics:      NewMetrics(),
+	}
+	node.stats = newNodeMetrics(node.metrics)
+	node.agent = &nodeAgent{node: node}
+	go node.clients.run()
+	broker.Update(node.agent, []string{disconnectChannel, broadcastChannel}, nil)
+	return node
+}
+
+// Config returns a copy of the Config that the node was created with.
+func (node *Node) Config() Config {
+	return node.config
+}
+
+// CreateMutator returns a ready to use Mutator from the node's Backend. The
+// Mutator must be .Closed() when it is no longer needed.
 //
 // Panic if NewContainer is not initialized.
 //
@@ -45,15 +163,12 @@ func (node *Node) CreateMutator() Mutator {
 		panic("Tried to get a mutator, but not NewContainer is not set")
 	}
 
-	return &MongoSynk{
-		Creator:   node.NewContainer,
-		Coll:      node.mongoSession.Clone().DB(MongoDBName).C("objects"),
-		RedisPool: node.redisPool,
-	}
+	return node.backend.NewMutator(node)
 }
 
-// CreateLoader returns a ready to use Loader. The Loader must be .Closed()
-// when it is no longer needed.
+// CreateLoader returns a ready to use Loader from the node's Backend. The
+// Loader must be .Closed() when it is no longer needed. Every synkClient gets
+// its Loader from here.
 //
 // Panic if NewContainer is not initialized.
 func (node *Node) CreateLoader() Loader {
@@ -61,13 +176,49 @@ func (node *Node) CreateLoader() Loader {
 		panic("Tried to get a Loader, but not NewContainer is not set")
 	}
 
-	return &MongoSynk{
-		Creator:   node.newContainer,
-		Coll:      node.mongoSession.Clone().DB(MongoDBName).C("objects"),
-		RedisPool: node.redisPool,
+	return node.backend.NewLoader(node)
+}
+
+// SetLogger replaces the node's Logger. The Logger is also used by the node's
+// Broker, and by Mutators and Loaders created after the call.
+func (node *Node) SetLogger(logger Logger) {
+	node.logger = loggerOrDefault(logger)
+	if rb, ok := node.broker.(*RedisBroker); ok {
+		rb.SetLogger(node.logger)
 	}
 }
 
+// Logger returns the node's Logger.
+func (node *Node) Logger() Logger {
+	return node.logger
+}
+
+// Metrics returns the node's Metrics registry. The registry is an http.Handler
+// that serves the node's metrics in the Prometheus text format:
+//
+// http.Handle("/metrics", node.Metrics())
+func (node *Node) Metrics() *Metrics {
+	return node.metrics
+}
+
+// Backend returns the Backend that creates the node's Mutators and Loaders.
+func (node *Node) Backend() Backend {
+	return node.backend
+}
+
+// RedisPool returns the node's redis connection pool. Custom Backends may use
+// it to publish messages to clients.
+func (node *Node) RedisPool() *redis.Pool {
+	return node.redisPool
+}
+
+// MongoSession returns the node's root mongodb session, or nil if the node was
+// created without mongodb. Callers must Copy() or Clone() the session rather
+// than using or closing it directly.
+func (node *Node) MongoSession() *mgo.Session {
+	return node.mongoSession
+}
+
 // RegisterClientConstructor sets function that will be called to create a
 // custom client. Consumer code must register a constructor to provide custom
 // handlers for messages from WebSocket clients.
@@ -78,6 +229,62 @@ func (node *Node) RegisterClientConstructor(constructor ClientConstructor) {
 	node.newClient = constructor
 }
 
+// RegisterNamedClientConstructor adds a ClientConstructor that Handlers can
+// select by name. This lets a single node serve several kinds of CustomClient,
+// for example "player", "spectator" and "editor". See Handler.Select.
+//
+// Names must be unique. The empty name is reserved for the constructor
+// registered with RegisterClientConstructor.
+func (node *Node) RegisterNamedClientConstructor(name string, constructor ClientConstructor) {
+	if name == "" {
+		panic("synk.Node cannot register a named ClientConstructor with an empty name")
+	}
+	if _, ok := node.namedClients[name]; ok {
+		panic("synk.Node cannot register an additional ClientConstructor named " + name)
+	}
+	node.namedClients[name] = constructor
+}
+
+// clientConstructor returns the ClientConstructor registered with name. The
+// empty name returns the constructor registered with RegisterClientConstructor.
+func (node *Node) clientConstructor(name string) (ClientConstructor, bool) {
+	if name == "" {
+		return node.newClient, node.newClient != nil
+	}
+	constructor, ok := node.namedClients[name]
+	return constructor, ok
+}
+
+// SetAuthenticator sets the Authenticator used by the node's Handlers. A
+// Handler with its own Authenticator uses that instead. If no Authenticator
+// is set, every request is accepted, and Client.Principal() returns nil.
+func (node *Node) SetAuthenticator(auth Authenticator) {
+	node.auth = auth
+}
+
+// SetSubscriptionAuthorizer sets the SubscriptionAuthorizer for clients whose
+// CustomClient does not implement SubscriptionAuthorizer. If none is set,
+// clients may subscribe to any key.
+func (node *Node) SetSubscriptionAuthorizer(auth SubscriptionAuthorizer) {
+	node.subAuth = auth
+}
+
+// SetLoadBatchSize changes how objects are sent to clients when they
+// subscribe. By default, each object is sent in its own add message. If size
+// is greater than zero, objects are grouped by subscription key into addBatch
+// messages instead:
+//
+// {"method":"addBatch","sKey":"m:0|0","objs":[<add message>, ...]}
+//
+// Each addBatch message is at most size bytes long, unless it holds a single
+// object that does not fit. Once all of a key's objects have been sent, the client is
+// sent {"method":"subscribed","sKey":"m:0|0"}, even if the key has no
+// objects. This lets the browser render a key's objects at once, and know
+// when loading is finished.
+func (node *Node) SetLoadBatchSize(size int) {
+	node.batchSize = size
+}
+
 // RegisterContainerConstructor sets the function that will be called to create
 // containers for synk objects. It is the responsibility of client code to
 // register a constructor that handles objects based on their type key.
@@ -100,61 +307,113 @@ func (node *Node) NewClient(c Client) CustomClient {
 	return node.newClient(c)
 }
 
+// Shutdown gracefully stops the node. Shutdown works in the following order:
+//
+//  1. Handlers stop accepting new websocket connections
+//  2. Every connected client is sent a websocket close frame with the
+//     CloseServiceRestart code, which hints that the client should reconnect
+//     (probably to another node)
+//  3. Wait for each client to finish tearing down
+//  4. End the sessions of disconnected clients. See EnableSessionResume
+//  5. Close the Broker, the redis pool and the mongodb session
+//
+// If ctx expires before all the clients finish, Shutdown stops waiting,
+// closes the node's connections anyway, and returns ctx.Err(). Shutdown may
+// only be called once. Subsequent calls return an error.
+func (node *Node) Shutdown(ctx context.Context) error {
+	node.mutex.Lock()
+	if node.closing {
+		node.mutex.Unlock()
+		return errors.New("synk.Node.Shutdown: node is already shut down")
+	}
+	node.closing = true
+	node.mutex.Unlock()
+
+	for _, client := range node.clients.list() {
+		go client.closeWithReason(websocket.CloseServiceRestart, shutdownReason)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		node.clientsWG.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	node.clients.stop()
+	node.endSessions()
+	node.broker.Close()
+	if node.redisPool != nil {
+		node.redisPool.Close()
+	}
+	if node.mongoSession != nil {
+		node.mongoSession.Close()
+	}
+	return err
+}
+
+// isClosing reports if Shutdown has been called.
+func (node *Node) isClosing() bool {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return node.closing
+}
+
+// beginConnection must be called before a Handler upgrades a request. If the
+// node is shutting down, it returns false, and the request must be rejected.
+// Otherwise, endConnection must be called once the connection is torn down.
+func (node *Node) beginConnection() bool {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if node.closing {
+		return false
+	}
+	node.clientsWG.Add(1)
+	return true
+}
+
+func (node *Node) endConnection() {
+	node.clientsWG.Done()
+}
+
 // Helpers
 
 // DialRedisPool creates a redigo connection pool with the default synk
-// configuration. The synk package level RedisAddr which is adapted from the
-// SYNK_REDIS_ADDR environment variable is used to connect.
+// configuration. The SYNK_REDIS_ADDR environment variable, or the package
+// level RedisAddr if it was changed, is used to connect.
 //
-// Panic on connection error
+// Connection errors are returned by the pool's connections.
 func DialRedisPool() *redis.Pool {
-	return &redis.Pool{
-		MaxIdle:     100,
-		IdleTimeout: 240 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			conn, err := redis.Dial("tcp", RedisAddr, redis.DialConnectTimeout(8*time.Second))
-			if err != nil {
-				panic("Failed to connect to redis: " + err.Error())
-			}
-			return conn, err
-		},
-	}
+	return envConfig().DialRedisPool()
 }
 
 // DialRedis gets a redis connection with the default synk configuration. The
-// synk package level RedisAddr which is adapted from the SYNK_REDIS_ADDR
-// environment variable is used to connect.
+// SYNK_REDIS_ADDR environment variable, or the package level RedisAddr if it
+// was changed, is used to connect.
 //
 // Panic on connection error.
 func DialRedis() redis.Conn {
-	conn, err := redis.Dial("tcp", RedisAddr, redis.DialConnectTimeout(8*time.Second))
+	conn, err := envConfig().DialRedis()
 	if err != nil {
-		panic("Failed to connect to redis: " + err.Error())
+		panic(err.Error())
 	}
 	return conn
 }
 
 // DialMongo creates the first MongoSession. Further sessions should be created
 // with session.Copy()
+//
+// Panic on connection error.
 func DialMongo() *mgo.Session {
-	session, err := mgo.Dial(MongoAddr)
+	session, err := envConfig().DialMongo()
 	if err != nil {
-		panic("Error Dialing mongodb: " + err.Error())
-	}
-
-	if mongoLoginRequired {
-		err = session.Login(&mgo.Credential{
-			Username:  mongoUser,
-			Password:  mongoPass,
-			Source:    MongoDBName,
-			Mechanism: "SCRAM-SHA-1",
-		})
-		if err != nil {
-			panic("Error Authorizing mongodb: " + err.Error())
-		} else {
-			fmt.Println("Successfully authenticated:", mongoUser)
-		}
+		panic(err.Error())
 	}
-
 	return session
 }
@@ -51,7 +51,7 @@ func NewSynk() *Pipe {
 
 		for val := range arc.toRedisChan {
 			if _, err := arc.toRedisConn.Do(val.commandName, val.args...); err != nil {
-				log.Printf("synk.Handler encountered an error trying to send %v: %s", val, err)
+				defaultLogger.Error("Pipe failed to send to redis", "command", val.commandName, "err", err)
 				break
 			}
 		}
@@ -0,0 +1,196 @@
+package synk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// defaultRPCTimeout is how long RPC handlers may run if the node's timeout is
+// not set with SetRPCTimeout.
+const defaultRPCTimeout = 10 * time.Second
+
+// An RPCHandler answers a request from a browser. params is the raw JSON
+// "params" value of the request, or nil if there was none. The returned
+// result is marshaled to JSON and sent back to the browser.
+//
+// ctx is cancelled when the request times out, or the client disconnects.
+// Handlers run in their own goroutine, so they may block, but they should
+// return promptly once ctx is done.
+//
+// To send an error to the browser, return an *RPCError. Other errors are
+// logged, and the browser receives an "internal" error without the details.
+type RPCHandler func(ctx context.Context, client Client, params json.RawMessage) (interface{}, error)
+
+// RPCError is an error that is sent to the browser in reply to a request.
+type RPCError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// RegisterRPC adds a handler for requests with the given method. A request is
+// a message from the browser such as:
+//
+// {"method":"move","rid":7,"params":{"x":3},"timeout":500}
+//
+// rid identifies the request, and may be a number or a string. timeout is
+// optional. It may shorten (but not extend) the node's RPC timeout, and is in
+// milliseconds. When the handler returns, the browser receives one of:
+//
+// {"method":"reply","rid":7,"result":<result>}
+// {"method":"reply","rid":7,"error":{"code":"timeout","message":"..."}}
+//
+// If the request cannot be decoded (for example, the timeout is not a number),
+// the handler is not called, and the browser receives a "decodeFailed" error.
+//
+// Messages for methods without a handler are passed to CustomClient.OnMessage
+// as before. Requests without a rid are handled, but not replied to.
+//
+// Panic if the method is already registered, or is reserved by synk.
+func (node *Node) RegisterRPC(method string, handler RPCHandler) {
+	if method == "" || method == "updateSubscription" {
+		panic("synk.Node cannot register an RPC handler for reserved method " + method)
+	}
+	if _, ok := node.msgHandlers[method]; ok {
+		panic("synk.Node cannot register an RPC handler for " + method + ", which has a message handler")
+	}
+	if _, ok := node.rpcHandlers[method]; ok {
+		panic("synk.Node cannot register an additional RPC handler for " + method)
+	}
+	node.rpcHandlers[method] = handler
+}
+
+// SetRPCTimeout sets the maximum time an RPC handler may take before the
+// browser receives a "timeout" error. The default is 10 seconds.
+func (node *Node) SetRPCTimeout(timeout time.Duration) {
+	node.rpcTimeout = timeout
+}
+
+type rpcRequest struct {
+	RID     json.RawMessage `json:"rid"`
+	Params  json.RawMessage `json:"params"`
+	Timeout int64           `json:"timeout"`
+}
+
+// replyMsg answers an RPC request
+type replyMsg struct {
+	Method replyMethod     `json:"method"`
+	RID    json.RawMessage `json:"rid"`
+	Result interface{}     `json:"result,omitempty"`
+	Error  *RPCError       `json:"error,omitempty"`
+}
+
+type replyMethod struct{}
+
+func (m replyMethod) MarshalJSON() ([]byte, error) {
+	return []byte("\"reply\""), nil
+}
+
+// call handles an RPC request in a new goroutine. May only be called from the
+// main loop.
+func (client *synkClient) call(handler RPCHandler, msg CustomMessage) {
+	var req rpcRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		client.logError("Client failed to parse RPC request", "method", msg.Method, "err", err)
+		// Unmarshal keeps decoding the other fields after a type error, so
+		// the rid is usually known.
+		if len(req.RID) > 0 {
+			bytes, _ := json.Marshal(replyMsg{RID: req.RID, Error: &RPCError{Code: "decodeFailed", Message: err.Error()}})
+			client.reply(bytes)
+		}
+		return
+	}
+
+	timeout := client.Node.rpcTimeout
+	if timeout == 0 {
+		timeout = defaultRPCTimeout
+	}
+	if requested := time.Duration(req.Timeout) * time.Millisecond; requested > 0 && requested < timeout {
+		timeout = requested
+	}
+
+	// The Handler waits for rpcs before it removes the client. Once the
+	// client is closed, the Handler may already be waiting.
+	client.rpcMutex.Lock()
+	select {
+	case <-client.closed:
+		client.rpcMutex.Unlock()
+		return
+	default:
+		client.rpcs.Add(1)
+	}
+	client.rpcMutex.Unlock()
+	go func() {
+		defer client.rpcs.Done()
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		go func() {
+			select {
+			case <-client.closed:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		type outcome struct {
+			result interface{}
+			err    error
+		}
+		done := make(chan outcome, 1)
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					done <- outcome{err: fmt.Errorf("panic: %v", r)}
+				}
+			}()
+			result, err := handler(ctx, client, req.Params)
+			done <- outcome{result, err}
+		}()
+
+		var out outcome
+		select {
+		case out = <-done:
+		case <-ctx.Done():
+			out.err = ctx.Err()
+		}
+
+		reply := replyMsg{RID: req.RID}
+		var rpcErr *RPCError
+		switch {
+		case out.err == nil:
+			reply.Result = out.result
+		case ctx.Err() == context.Canceled:
+			// The client disconnected
+			return
+		case ctx.Err() == context.DeadlineExceeded && errors.Is(out.err, context.DeadlineExceeded):
+			reply.Error = &RPCError{Code: "timeout", Message: "no reply within " + timeout.String()}
+		case errors.As(out.err, &rpcErr):
+			reply.Error = rpcErr
+		default:
+			client.logError("Client RPC handler failed", "method", msg.Method, "err", out.err)
+			reply.Error = &RPCError{Code: "internal", Message: "internal error"}
+		}
+
+		if len(req.RID) == 0 {
+			return
+		}
+
+		bytes, err := json.Marshal(reply)
+		if err != nil {
+			client.logError("Client failed to marshal RPC reply", "method", msg.Method, "err", err)
+			bytes, _ = json.Marshal(replyMsg{RID: req.RID, Error: &RPCError{Code: "internal", Message: "internal error"}})
+		}
+
+		select {
+		case client.toWebSocket <- bytes:
+		case <-client.closed:
+		}
+	}()
+}
@@ -42,3 +42,56 @@ return "NO"
 //
 // Returns "OK" if SET completed. "NO" If no operation occurred
 var setAndPublishScript = redis.NewScript(2, setAndPublishText)
+
+var modifyAndPublishText = `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return "NO"
+end
+if KEYS[2] ~= KEYS[3] then
+	redis.call("SREM", KEYS[2], KEYS[1])
+end
+redis.call("SADD", KEYS[3], KEYS[1])
+redis.call("SET", KEYS[1], ARGV[1])
+redis.call("PUBLISH", KEYS[2], ARGV[2])
+if KEYS[2] ~= KEYS[3] then
+	redis.call("PUBLISH", KEYS[3], ARGV[3])
+end
+return "OK"
+`
+
+// modifyAndPublishScript sets an existing synk Object, moves it to its new
+// subscription set, and publishes messages to clients. If the object does not
+// exist, nothing is set or published.
+//
+// Three keys
+// 1. object key (including it's type key and ID)
+// 2. previous subscription key
+// 3. new subscription key
+// Three args
+// 4. object JSON
+// 5. mod JSON - published on the previous subscription key
+// 6. add JSON - published on the new subscription key if the object moved
+//
+// Returns "OK" if SET completed. "NO" If no operation occurred
+var modifyAndPublishScript = redis.NewScript(3, modifyAndPublishText)
+
+var deleteAndPublishText = `
+if redis.call("DEL", KEYS[1]) == 0 then
+	return "NO"
+end
+redis.call("SREM", KEYS[2], KEYS[1])
+redis.call("PUBLISH", KEYS[2], ARGV[1])
+return "OK"
+`
+
+// deleteAndPublishScript deletes a synk Object, and publishes a message to
+// clients. If the object does not exist, nothing is published.
+//
+// Two keys
+// 1. object key (including it's type key and ID)
+// 2. subscription key
+// One arg
+// 3. rem JSON
+//
+// Returns "OK" if DEL completed. "NO" If no operation occurred
+var deleteAndPublishScript = redis.NewScript(2, deleteAndPublishText)
@@ -4,8 +4,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"strings"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -28,17 +28,21 @@ import (
 type RedisSynk struct {
 	Pool        *redis.Pool
 	Constructor ContainerConstructor
+	Logger      Logger   // Optional. If nil, log with the standard library
+	Metrics     *Metrics // Optional. If nil, metrics are not recorded
 }
 
 // Create an Object, and store it in Redis
-func (rs *RedisSynk) Create(obj Object) error {
+func (rs *RedisSynk) Create(obj Object) (err error) {
+	defer func(start time.Time) { rs.Metrics.observeMutation("redis", "create", start, err) }(time.Now())
 	conn := rs.Pool.Get()
 	defer conn.Close()
 	return redisNewObject(obj, conn)
 }
 
 // Delete an Object stored in Redis
-func (rs *RedisSynk) Delete(obj Object) error {
+func (rs *RedisSynk) Delete(obj Object) (err error) {
+	defer func(start time.Time) { rs.Metrics.observeMutation("redis", "delete", start, err) }(time.Now())
 	conn := rs.Pool.Get()
 	defer conn.Close()
 	return redisDelObject(obj, conn)
@@ -46,7 +50,8 @@ func (rs *RedisSynk) Delete(obj Object) error {
 }
 
 // Modify an Object stored in Redis
-func (rs *RedisSynk) Modify(obj Object) error {
+func (rs *RedisSynk) Modify(obj Object) (err error) {
+	defer func(start time.Time) { rs.Metrics.observeMutation("redis", "modify", start, err) }(time.Now())
 	conn := rs.Pool.Get()
 	defer conn.Close()
 	return redisModObject(obj, conn)
@@ -62,29 +67,23 @@ func (rs *RedisSynk) Load(subKeys []string) ([]Object, error) {
 	conn := rs.Pool.Get()
 	defer conn.Close()
 
-	return RedisRequestObjects(conn, subKeys, rs.Constructor)
+	return redisRequestObjects(conn, subKeys, rs.Constructor, loggerOrDefault(rs.Logger))
 }
 
 // Publish a message. If the message is a []byte, publish it directly. Otherwise
 // Marshal it to JSON.
 func (rs *RedisSynk) Publish(channel string, msg interface{}) error {
+	defer rs.Metrics.observePublish("redis", time.Now())
 	conn := rs.Pool.Get()
 	defer conn.Close()
 
-	var bytes []byte
-	var err error
-
-	if msg, ok := msg.([]byte); ok {
-		bytes = msg
-	} else {
-		bytes, err = json.Marshal(msg)
-		if err != nil {
-			return err
-		}
+	bytes, err := marshalMessage(msg)
+	if err != nil {
+		return err
 	}
 
 	_, err = conn.Do("PUBLISH", channel, bytes)
-	return err
+	return redisError("RedisSynk.Publish", err)
 }
 
 /***************************************************************
@@ -100,6 +99,10 @@ Note that these are not RedisSynk methods
 //
 // The two slices are gauranteed to be of equal length.
 func RedisRequestByteSlices(conn redis.Conn, subKeys []string) ([]string, [][]byte, error) {
+	return redisRequestByteSlices(conn, subKeys, defaultLogger)
+}
+
+func redisRequestByteSlices(conn redis.Conn, subKeys []string, logger Logger) ([]string, [][]byte, error) {
 	// The script requires the first argument to be the number of keys. We have to
 	// make it one element longer than the points array.
 	size := len(subKeys)
@@ -112,8 +115,8 @@ func RedisRequestByteSlices(conn redis.Conn, subKeys []string) ([]string, [][]by
 	// redis.Values will return []interface{}
 	keysAndObjects, err := redis.Values(GetKeysObjects.Do(conn, args...))
 	if err != nil {
-		log.Println("RequestByteSlices - get values fail: " + err.Error())
-		return nil, nil, err
+		logger.Error("RedisRequestByteSlices failed to get values", "err", err)
+		return nil, nil, redisError("RedisSynk.Load", err)
 	}
 
 	if len(keysAndObjects) == 0 {
@@ -127,7 +130,8 @@ func RedisRequestByteSlices(conn redis.Conn, subKeys []string) ([]string, [][]by
 		txt = txt + fmt.Sprintf("RequestByteSlices keys: %s\n", keys)
 		txt = txt + fmt.Sprintf("RequestByteSlices vals: %s\n", vals)
 		txt = txt + fmt.Sprintf("RequestByteSlices len(keys): %v\n", len(keys))
-		log.Println(txt)
+		logger.Error("RedisRequestByteSlices got mismatched or invalid response from redis",
+			"keys", len(keys), "vals", len(vals))
 		return nil, nil, errors.New(txt)
 	}
 
@@ -139,7 +143,11 @@ func RedisRequestByteSlices(conn redis.Conn, subKeys []string) ([]string, [][]by
 //
 // The caller must provide a function for converting typeKey+bytes to objects.
 func RedisRequestObjects(conn redis.Conn, subKeys []string, constructor ContainerConstructor) ([]Object, error) {
-	keys, vals, err := RedisRequestByteSlices(conn, subKeys)
+	return redisRequestObjects(conn, subKeys, constructor, defaultLogger)
+}
+
+func redisRequestObjects(conn redis.Conn, subKeys []string, constructor ContainerConstructor, logger Logger) ([]Object, error) {
+	keys, vals, err := redisRequestByteSlices(conn, subKeys, logger)
 	if err != nil {
 		return nil, err
 	}
@@ -170,7 +178,7 @@ func RedisRequestObjects(conn redis.Conn, subKeys []string, constructor Containe
 			results = append(results, container)
 		} else {
 			//BUG(charles): error is handled twice
-			log.Printf("Failed RequestObjects failed to create object: %s\n", err)
+			logger.Error("RedisRequestObjects failed to create object", "typeKey", key, "err", err)
 		}
 	}
 	return results, err
@@ -238,11 +246,11 @@ func redisNewObject(obj Object, rConn redis.Conn) error {
 	val, err := redis.String(setAndPublishScript.Do(rConn, redisKey, subKey, redisJSON, msgJSON))
 
 	if val == "NO" {
-		txt := "synk.redisNewObject failed to create object. Redis key '%s' already exists"
-		return fmt.Errorf(txt, redisKey)
+		txt := "redis key '%s' already exists"
+		return &Error{Op: "RedisSynk.Create", Kind: ErrConflict, Err: fmt.Errorf(txt, redisKey)}
 	}
 
-	return err
+	return redisError("RedisSynk.Create", err)
 }
 
 // This is the newer updated Objects mutator.
@@ -281,48 +289,42 @@ func redisModObject(m Object, rConn redis.Conn) error {
 		return errors.New("redisModObject failed to convert object to JSON")
 	}
 
-	// Is the object in the same chunk as before?
-	if simple {
-		rConn.Send("MULTI")
-		rConn.Send("SADD", nsk, redisKey) // Redundant, but safer
-		rConn.Send("SET", redisKey, objJSON)
-		rConn.Send("PUBLISH", psk, msgJSON)
-		_, err = rConn.Do("EXEC")
-		return err
-	}
+	// If the object changed chunks, clients subscribed to the new chunk get
+	// the full state.
+	var addJSON []byte
+	if !simple {
+		addMsg := addMsg{
+			State:   m.State(),
+			ID:      id,
+			SKey:    nsk,
+			PSKey:   psk,
+			Version: m.Version(),
+			Type:    m.TypeKey(),
+		}
+		addJSON, err = json.Marshal(addMsg)
+		if err != nil {
+			return errors.New("redisModObject failed to convert full state to JSON")
+		}
 
-	// The object changed chunks. We will need to update two redis sets, and
-	// publish in two places.
-	addMsg := addMsg{
-		State:   m.State(),
-		ID:      id,
-		SKey:    nsk,
-		PSKey:   psk,
-		Version: m.Version(),
-		Type:    m.TypeKey(),
+		// This line below is a hack that I am using to tell our sever to
+		// condionally send this message to the client. If the client is
+		// subscribed to the chunk that this object is moving from, then that
+		// client will receive the diff and they do not need or want to receive
+		// the addObj message. Our websocket server checks if JSON messages are
+		// prefixed with the from string, and only sends the message to the
+		// client if it is needed.
+		addJSON = []byte("from " + psk + string(addJSON))
 	}
-	addJSON, err := json.Marshal(addMsg)
-	if err != nil {
-		return errors.New("redisModObject failed to convert full state to JSON")
+
+	// The script ensures that we do not accidentally recreate a deleted object
+	val, err := redis.String(modifyAndPublishScript.Do(rConn, redisKey, psk, nsk, objJSON, msgJSON, addJSON))
+
+	if val == "NO" {
+		txt := "redis key '%s' does not exist"
+		return &Error{Op: "RedisSynk.Modify", Kind: ErrNotFound, Err: fmt.Errorf(txt, redisKey)}
 	}
 
-	// This line below is a hack that I am using to tell our sever to condionally
-	// send this message to the client. If the client is subscribed to the chunk
-	// that this object is moving from, then that client will receive the diff and
-	// they do not need or want to receive the addObj message. Our websocket
-	// server checks if JSON messages are prefixed with the from string, and only
-	// sends the message to the client if it is needed.
-	addJSON = []byte("from " + psk + string(addJSON))
-
-	rConn.Send("MULTI")
-	rConn.Send("SREM", psk, redisKey)
-	rConn.Send("SADD", nsk, redisKey)
-	rConn.Send("SET", redisKey, objJSON)
-	rConn.Send("PUBLISH", psk, msgJSON)
-	rConn.Send("PUBLISH", nsk, addJSON)
-	_, err = rConn.Do("EXEC")
-
-	return err
+	return redisError("RedisSynk.Modify", err)
 }
 
 func redisDelObject(obj Object, rConn redis.Conn) error {
@@ -344,13 +346,14 @@ func redisDelObject(obj Object, rConn redis.Conn) error {
 
 	redisKey := redisKey(obj)
 
-	rConn.Send("MULTI")
-	rConn.Send("SREM", remMsg.SKey, redisKey)
-	rConn.Send("DEL", redisKey)
-	rConn.Send("PUBLISH", remMsg.SKey, remJSON)
-	_, err = rConn.Do("EXEC")
+	val, err := redis.String(deleteAndPublishScript.Do(rConn, redisKey, remMsg.SKey, remJSON))
+
+	if val == "NO" {
+		txt := "redis key '%s' does not exist"
+		return &Error{Op: "RedisSynk.Delete", Kind: ErrNotFound, Err: fmt.Errorf(txt, redisKey)}
+	}
 
-	return err
+	return redisError("RedisSynk.Delete", err)
 }
 
 /******************************************************************************
@@ -0,0 +1,353 @@
+package synk
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// EnableSessionResume lets browsers resume their session after a brief
+// disconnect, without resubscribing and reloading every subscription key.
+//
+// When resume is enabled, the first message sent to every client is:
+//
+// {"method":"session","token":"...","resumed":false}
+//
+// The browser counts every message it receives after that one. To resume,
+// it reconnects with the token and the count in the query string:
+//
+// ws://example.com/ws?resume=<token>&received=<count>
+//
+// If the session can be resumed, the session message has "resumed":true. The
+// client has the same subscriptions as before, and is sent every message that
+// the browser did not receive, in order. The browser should keep counting from
+// where it left off. Otherwise, "resumed" is false, and the browser must
+// resubscribe as if it was connecting for the first time.
+//
+// A session is only resumed if the Authenticator returns a Principal equal
+// (by reflect.DeepEqual) to the one of the client that started it. Each
+// restored subscription key is checked again by the SubscriptionAuthorizer.
+// Keys that it rejects or rewrites are dropped, and reported to the browser in
+// a "subscriptionError" message after the messages it missed. The remaining
+// keys are passed to the CustomClient's OnSubscribe, with nil objs, because
+// nothing is loaded.
+//
+// After a disconnect, the session is kept for the grace period. At most limit
+// messages are kept for a session: both the most recent messages sent to the
+// browser, and the messages published while it is disconnected. A session
+// that falls further behind cannot be resumed. Sessions that end with a close
+// frame sent by the server (for example during Shutdown) cannot be resumed.
+//
+// The token grants access to the session, so it must be kept secret. Browsers
+// cannot set headers on websocket requests, so the token is sent in the query
+// string, where proxies and access logs may record it. Configure them to
+// omit the resume parameter.
+func (node *Node) EnableSessionResume(grace time.Duration, limit int) {
+	node.resumeGrace = grace
+	node.resumeLimit = limit
+}
+
+// newSession creates and registers a session for client
+func (node *Node) newSession(client *synkClient) *session {
+	s := &session{
+		node:      node,
+		token:     newSessionToken(),
+		principal: client.principal,
+		client:    client,
+	}
+	node.sessionMutex.Lock()
+	node.sessions[s.token] = s
+	node.sessionMutex.Unlock()
+	return s
+}
+
+func (node *Node) session(token string) *session {
+	node.sessionMutex.Lock()
+	defer node.sessionMutex.Unlock()
+	return node.sessions[token]
+}
+
+func (node *Node) removeSession(token string) {
+	node.sessionMutex.Lock()
+	delete(node.sessions, token)
+	node.sessionMutex.Unlock()
+}
+
+// endSessions ends all sessions, so they cannot be resumed
+func (node *Node) endSessions() {
+	node.sessionMutex.Lock()
+	sessions := make([]*session, 0, len(node.sessions))
+	for _, s := range node.sessions {
+		sessions = append(sessions, s)
+	}
+	node.sessionMutex.Unlock()
+
+	for _, s := range sessions {
+		s.end()
+	}
+}
+
+func newSessionToken() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic("synk: failed to read random bytes for session token: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// A session outlives the synkClients that it is attached to. When resume is
+// enabled, the session (not the client) is the Agent subscribed with the
+// Broker. While a client is attached, messages are passed to it. Otherwise
+// they are kept until a new client resumes the session, or the session ends.
+type session struct {
+	node      *Node
+	token     string
+	principal interface{} // only a client with this principal may resume
+
+	mutex  sync.Mutex
+	client *synkClient // the attached client, or nil
+	parked bool        // the last client's main loop exited
+	ended  bool
+	subs   map[string]bool // the last client's subscriptions, once parked
+	timer  *time.Timer     // ends the session once the grace period expires
+
+	// log holds the most recent messages written to the browser. The last
+	// message in the log is number seq.
+	log [][]byte
+	seq uint64
+
+	// pending holds the messages that were not written to the browser
+	pending []sessionEntry
+}
+
+// sessionEntry is a message received from the Broker. If channel is "", data
+// has already been filtered by synkClient.filter.
+type sessionEntry struct {
+	channel string
+	data    []byte
+}
+
+// Receive passes messages to the attached client, or keeps them
+func (s *session) Receive(channel string, data []byte) error {
+	s.mutex.Lock()
+	client := s.client
+	if client == nil {
+		s.keep(sessionEntry{channel: channel, data: data})
+		s.mutex.Unlock()
+		return nil
+	}
+	s.mutex.Unlock()
+	return client.Receive(channel, data)
+}
+
+// Resync passes the request to the attached client, or keeps a resync message
+func (s *session) Resync(subKeys []string) {
+	subKeys = withoutReservedKeys(subKeys)
+	if len(subKeys) == 0 {
+		return
+	}
+	s.mutex.Lock()
+	client := s.client
+	if client == nil {
+		if data, err := json.Marshal(resyncMsg{SKeys: subKeys}); err == nil {
+			s.keep(sessionEntry{data: data})
+		}
+		s.mutex.Unlock()
+		return
+	}
+	s.mutex.Unlock()
+	client.Resync(subKeys)
+}
+
+// keep a message for a future client. Must be called while holding the mutex.
+func (s *session) keep(entry sessionEntry) {
+	if s.ended {
+		return
+	}
+	if len(s.pending) >= s.node.resumeLimit {
+		s.endLocked()
+		return
+	}
+	s.pending = append(s.pending, entry)
+}
+
+// written records a message that the attached client wrote to the browser.
+// Called from the client's main loop.
+func (s *session) written(msg []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ended {
+		return
+	}
+	s.seq++
+	s.log = append(s.log, msg)
+	if len(s.log) > s.node.resumeLimit {
+		s.log[0] = nil
+		s.log = s.log[1:]
+	}
+}
+
+// detach stops passing messages to client. Messages received after the call
+// are kept.
+func (s *session) detach(client *synkClient) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client == client {
+		s.client = nil
+	}
+	s.startTimer()
+}
+
+// park is called when the client's main loop exits. It detaches the client,
+// and keeps its subscriptions, and any messages that it did not write.
+func (s *session) park(client *synkClient) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client == client {
+		s.client = nil
+	}
+	if s.ended || s.parked {
+		return
+	}
+
+	s.subs = make(map[string]bool, len(client.subscriptions))
+	for subKey := range client.subscriptions {
+		s.subs[subKey] = true
+	}
+
+	// Messages still in the toWebSocket channel were received before the
+	// ones in pending.
+	var unsent []sessionEntry
+	for drained := false; !drained; {
+		select {
+		case msg := <-client.toWebSocket:
+			unsent = append(unsent, sessionEntry{data: msg})
+		default:
+			drained = true
+		}
+	}
+	s.pending = append(unsent, s.pending...)
+	if len(s.pending) > s.node.resumeLimit {
+		s.endLocked()
+		return
+	}
+
+	s.parked = true
+	s.startTimer()
+}
+
+// startTimer starts the grace period once the session can be resumed. Must
+// be called while holding the mutex.
+func (s *session) startTimer() {
+	if s.client == nil && s.parked && !s.ended && s.timer == nil {
+		var timer *time.Timer
+		timer = time.AfterFunc(s.node.resumeGrace, func() { s.expire(timer) })
+		s.timer = timer
+	}
+}
+
+// expire ends the session, unless it was resumed after timer fired.
+func (s *session) expire(timer *time.Timer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.timer == timer {
+		s.endLocked()
+	}
+}
+
+// resume attaches client to the session. received is the number of messages
+// the browser received. Return the messages that the client must write before
+// any others, and the subscription keys that the client's
+// SubscriptionAuthorizer no longer approves. Return false if the session
+// cannot be resumed.
+//
+// Must be called before the client's goroutines start.
+func (s *session) resume(client *synkClient, received uint64) ([][]byte, []string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.ended || !s.parked || s.client != nil {
+		return nil, nil, false
+	}
+	if !reflect.DeepEqual(s.principal, client.principal) {
+		client.logInfo("Client may not resume a session started by another principal")
+		return nil, nil, false
+	}
+
+	oldest := s.seq - uint64(len(s.log))
+	if received < oldest || received > s.seq {
+		// We no longer have the messages the browser missed
+		s.endLocked()
+		return nil, nil, false
+	}
+
+	// A restored key must be approved unchanged. The browser is subscribed
+	// to the key, not to a replacement.
+	var rejected []string
+	for subKey := range s.subs {
+		if approved, _ := client.authorize([]string{subKey}); len(approved) != 1 || approved[0] != subKey {
+			rejected = append(rejected, subKey)
+			delete(s.subs, subKey)
+		}
+	}
+	sort.Strings(rejected)
+
+	replay := make([][]byte, 0, int(s.seq-received)+len(s.pending)+1)
+	replay = append(replay, s.log[received-oldest:]...)
+	if bytes := client.subscriptionError(rejected); bytes != nil {
+		replay = append(replay, bytes)
+	}
+	for _, entry := range s.pending {
+		if entry.channel == "" {
+			replay = append(replay, entry.data)
+		} else if msg, ok := client.filter(s.subs, entry.channel, entry.data); ok {
+			replay = append(replay, msg)
+		}
+	}
+
+	// The replayed messages will be written again, and logged with the same
+	// numbers.
+	s.log = s.log[:received-oldest]
+	s.seq = received
+	s.pending = nil
+	s.parked = false
+	s.timer.Stop()
+	s.timer = nil
+
+	client.subscriptions = s.subs
+	s.subs = nil
+	s.client = client
+	return replay, rejected, true
+}
+
+// end the session, so it cannot be resumed. Safe for concurrent calls.
+func (s *session) end() {
+	s.mutex.Lock()
+	s.endLocked()
+	s.mutex.Unlock()
+}
+
+// Must be called while holding the mutex.
+func (s *session) endLocked() {
+	if s.ended {
+		return
+	}
+	s.ended = true
+	s.client = nil
+	s.log = nil
+	s.pending = nil
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+
+	// The Broker may be delivering a message to this session, so don't wait
+	// for it.
+	go func() {
+		s.node.removeSession(s.token)
+		s.node.broker.RemoveAgent(s)
+	}()
+}
@@ -0,0 +1,213 @@
+package stest
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CharlesHolbrow/synk"
+	"github.com/gorilla/websocket"
+)
+
+func TestMemoryNode_DisconnectSlowClients(t *testing.T) {
+	node, server := newMemoryServer(t)
+	node.SetBackpressurePolicy(synk.DisconnectSlowClients(50 * time.Millisecond))
+	conn := dial(t, server)
+	subscribe(conn, []string{"big"}, nil)
+
+	// Publish until the client's buffer, and the TCP buffers behind it, are
+	// full. The test client never reads.
+	loader := node.CreateLoader()
+	defer loader.Close()
+	big := []byte(`{"method":"big","pad":"` + strings.Repeat("x", 64*1024) + `"}`)
+	disconnects := node.Metrics().Counter("synk_slow_client_disconnects_total", "")
+	for deadline := time.Now().Add(5 * time.Second); disconnects.Value() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the slow client to be disconnected")
+		}
+		loader.Publish("big", big)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Clients that disconnect while messages are published to them must not crash
+// the node.
+func TestMemoryNode_ChurnUnderLoad(t *testing.T) {
+	node, server := newMemoryServer(t)
+	churn(t, node, server)
+}
+
+// churn connects and disconnects 400 clients subscribed to a key that is
+// flooded with messages.
+func churn(t *testing.T, node *synk.Node, server *httptest.Server) {
+	loader := node.CreateLoader()
+	defer loader.Close()
+
+	done := make(chan struct{})
+	flooded := make(chan struct{})
+	go func() {
+		defer close(flooded)
+		msg := []byte(`{"method":"flood"}`)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				loader.Publish("flood", msg)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 400; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL(server), nil)
+			if err != nil {
+				return
+			}
+			subscribe(conn, []string{"flood"}, nil)
+			time.Sleep(time.Duration(rand.Intn(20)) * time.Millisecond)
+			conn.Close()
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-flooded
+
+	waitFor(t, "every client to leave the pool", func() bool {
+		return node.Metrics().Gauge("synk_clients", "").Value() == 0
+	})
+}
+
+// fillBuffer publishes large messages on the "big" key until the client's
+// outgoing buffer is full, and then enough more to be sure that the TCP
+// buffers behind it are full too. The client must not read until the test is
+// ready.
+func fillBuffer(t *testing.T, node *synk.Node, loader synk.Loader) {
+	big := []byte(`{"method":"big","pad":"` + strings.Repeat("x", 64*1024) + `"}`)
+	full := node.Metrics().Counter("synk_client_buffer_full_total", "")
+	for deadline := time.Now().Add(5 * time.Second); full.Value() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the client's buffer to fill")
+		}
+		loader.Publish("big", big)
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 200; i++ {
+		loader.Publish("big", big)
+	}
+}
+
+// readSkipping reads the next message whose method is not "big"
+func readSkipping(t *testing.T, conn *websocket.Conn, v interface{}) {
+	for {
+		var raw json.RawMessage
+		readJSON(t, conn, &raw)
+		var msg testMsg
+		if json.Unmarshal(raw, &msg); msg.Method != "big" {
+			json.Unmarshal(raw, v)
+			return
+		}
+	}
+}
+
+func TestMemoryNode_ResyncSlowClients(t *testing.T) {
+	node, server := newMemoryServer(t)
+	node.SetBackpressurePolicy(synk.ResyncSlowClients())
+	conn := dial(t, server)
+	subscribe(conn, []string{"big", "b", "a"}, nil)
+	waitFor(t, "the subscription", func() bool {
+		return node.Metrics().Gauge("synk_subscriptions", "").Value() == 3
+	})
+
+	loader := node.CreateLoader()
+	defer loader.Close()
+	fillBuffer(t, node, loader)
+	loader.Publish("b", []byte(`{"method":"lost"}`))
+	loader.Publish("a", []byte(`{"method":"lost"}`))
+
+	var msg struct {
+		Method string   `json:"method"`
+		SKeys  []string `json:"sKeys"`
+	}
+	readSkipping(t, conn, &msg)
+	if msg.Method != "resync" || strings.Join(msg.SKeys, ",") != "a,b,big" {
+		t.Error("Expected a resync message for a, b and big. Got:", msg)
+	}
+}
+
+func TestMemoryNode_CoalesceSlowClients(t *testing.T) {
+	node, server := newMemoryServer(t)
+	node.SetBackpressurePolicy(synk.CoalesceSlowClients())
+	conn := dial(t, server)
+	subscribe(conn, []string{"big", "m:0|0"}, nil)
+	waitFor(t, "the subscription", func() bool {
+		return node.Metrics().Gauge("synk_subscriptions", "").Value() == 2
+	})
+
+	loader := node.CreateLoader()
+	defer loader.Close()
+	fillBuffer(t, node, loader)
+	for _, msg := range []string{
+		`{"method":"mod","id":"o","sKey":"m:0|0","v":1,"diff":{"x":1}}`,
+		`{"method":"mod","id":"o","sKey":"m:0|0","v":2,"diff":{"y":2}}`,
+		// Later mods must not be merged into a mod before this message
+		`{"method":"note","id":"o","sKey":"m:0|0"}`,
+		`{"method":"mod","id":"o","sKey":"m:0|0","v":3,"diff":{"z":3}}`,
+	} {
+		loader.Publish("m:0|0", []byte(msg))
+	}
+
+	type modMsg struct {
+		Method  string         `json:"method"`
+		Version uint           `json:"v"`
+		Diff    map[string]int `json:"diff"`
+	}
+	var msg modMsg
+	if readSkipping(t, conn, &msg); msg.Method != "mod" || msg.Version != 2 || len(msg.Diff) != 2 || msg.Diff["x"] != 1 || msg.Diff["y"] != 2 {
+		t.Error("Expected the first two mods to be merged. Got:", msg)
+	}
+	msg = modMsg{}
+	if readSkipping(t, conn, &msg); msg.Method != "note" {
+		t.Error("Expected the note message. Got:", msg)
+	}
+	msg = modMsg{}
+	if readSkipping(t, conn, &msg); msg.Method != "mod" || msg.Version != 3 || len(msg.Diff) != 1 || msg.Diff["z"] != 3 {
+		t.Error("Expected the last mod on its own. Got:", msg)
+	}
+	if coalesced := node.Metrics().Counter("synk_slow_client_coalesced_total", "").Value(); coalesced != 1 {
+		t.Error("Expected one coalesced message. Got:", coalesced)
+	}
+}
+
+func TestMemoryNode_CoalesceLimit(t *testing.T) {
+	node, server := newMemoryServer(t)
+	node.SetBackpressurePolicy(synk.CoalesceSlowClients())
+	conn := dial(t, server)
+	subscribe(conn, []string{"big"}, nil)
+	waitFor(t, "the subscription", func() bool {
+		return node.Metrics().Gauge("synk_subscriptions", "").Value() == 1
+	})
+
+	loader := node.CreateLoader()
+	defer loader.Close()
+	fillBuffer(t, node, loader)
+
+	// Messages without an id are never merged
+	disconnects := node.Metrics().Counter("synk_slow_client_disconnects_total", "")
+	for i := 0; i < 5000 && disconnects.Value() == 0; i++ {
+		loader.Publish("big", []byte(`{"method":"small"}`))
+	}
+	waitFor(t, "the slow client to be disconnected", func() bool {
+		return disconnects.Value() == 1
+	})
+	if err := readClose(conn); !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Error("Expected the client to be closed with CloseTryAgainLater. Got:", err)
+	}
+}
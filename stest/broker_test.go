@@ -0,0 +1,202 @@
+package stest
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CharlesHolbrow/synk"
+	"github.com/garyburd/redigo/redis"
+)
+
+// fakeConn is a redis connection. Replies to subscriptions are queued with
+// publish, and SUBSCRIBE commands are recorded. PING is answered by calling
+// ping, and scripts are answered by calling eval, if they are set.
+type fakeConn struct {
+	replies chan interface{}
+	closed  chan struct{}
+	once    sync.Once
+	ping    func(timeout time.Duration) error
+	eval    func(args ...interface{}) (interface{}, error)
+
+	mutex    sync.Mutex
+	commands []string
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{replies: make(chan interface{}, 10), closed: make(chan struct{})}
+}
+
+// publish delivers data on channel, as if it was published in redis
+func (fc *fakeConn) publish(channel, data string) {
+	fc.replies <- []interface{}{[]byte("message"), []byte(channel), []byte(data)}
+}
+
+// subscribed returns the channels of each SUBSCRIBE command sent so far
+func (fc *fakeConn) subscribed() []string {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	return append([]string(nil), fc.commands...)
+}
+
+func (fc *fakeConn) Close() error {
+	fc.once.Do(func() { close(fc.closed) })
+	return nil
+}
+func (fc *fakeConn) Err() error   { return nil }
+func (fc *fakeConn) Flush() error { return nil }
+func (fc *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return fc.DoWithTimeout(0, cmd, args...)
+}
+func (fc *fakeConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	switch {
+	case cmd == "":
+		// redigo flushes pooled connections with an empty command
+		return nil, nil
+	case cmd == "PING" && fc.ping != nil:
+		if err := fc.ping(timeout); err != nil {
+			return nil, err
+		}
+		return "PONG", nil
+	case cmd == "EVALSHA" && fc.eval != nil:
+		return fc.eval(args...)
+	}
+	return nil, errors.New("fakeConn: " + cmd + " is not supported")
+}
+func (fc *fakeConn) Send(cmd string, args ...interface{}) error {
+	if cmd == "SUBSCRIBE" {
+		fc.mutex.Lock()
+		for _, arg := range args {
+			fc.commands = append(fc.commands, arg.(string))
+		}
+		fc.mutex.Unlock()
+	}
+	return nil
+}
+func (fc *fakeConn) Receive() (interface{}, error) {
+	return fc.ReceiveWithTimeout(0)
+}
+func (fc *fakeConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	select {
+	case reply := <-fc.replies:
+		return reply, nil
+	case <-fc.closed:
+		return nil, errors.New("fakeConn: connection closed")
+	}
+}
+
+// recordingAgent reports the messages it receives, and its resync requests
+type recordingAgent struct {
+	messages chan string
+	resyncs  chan []string
+}
+
+func (ra *recordingAgent) Receive(channel string, data []byte) error {
+	ra.messages <- channel + ":" + string(data)
+	return nil
+}
+
+func (ra *recordingAgent) Resync(channels []string) {
+	ra.resyncs <- channels
+}
+
+func TestRedisBroker_Reconnect(t *testing.T) {
+	conns := make(chan *fakeConn, 3)
+	failures := 1
+	dial := func() (redis.Conn, error) {
+		if len(conns) > 0 && failures > 0 {
+			// Fail the first redial, so the broker must back off and retry
+			failures--
+			return nil, errors.New("fakeConn: connection refused")
+		}
+		conn := newFakeConn()
+		conns <- conn
+		return conn, nil
+	}
+
+	broker, err := synk.NewRedisBroker(synk.Config{
+		RedisDial:         dial,
+		RedisReconnectMin: time.Millisecond,
+		RedisReconnectMax: 10 * time.Millisecond,
+		Logger:            &testLogger{events: make(chan logEvent, 10)},
+	})
+	if err != nil {
+		t.Fatal("NewRedisBroker failed:", err)
+	}
+	defer broker.Close()
+	first := <-conns
+
+	agent := &recordingAgent{messages: make(chan string, 1), resyncs: make(chan []string, 1)}
+	broker.Update(agent, []string{"a"}, nil)
+	if subs := first.subscribed(); len(subs) != 1 || subs[0] != "a" {
+		t.Error("Expected SUBSCRIBE a. Got:", subs)
+	}
+	first.publish("a", "one")
+	if msg := <-agent.messages; msg != "a:one" {
+		t.Error("Expected to receive a:one. Got:", msg)
+	}
+
+	// The connection drops. The broker redials, resubscribes, and asks the
+	// agent to resync.
+	first.Close()
+	var second *fakeConn
+	select {
+	case second = <-conns:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the broker to redial")
+	}
+	select {
+	case channels := <-agent.resyncs:
+		if len(channels) != 1 || channels[0] != "a" {
+			t.Error("Expected a resync for a. Got:", channels)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the agent to be told to resync")
+	}
+	if subs := second.subscribed(); len(subs) != 1 || subs[0] != "a" {
+		t.Error("Expected the new connection to SUBSCRIBE a. Got:", subs)
+	}
+	if !broker.Connected() {
+		t.Error("Expected the broker to be connected")
+	}
+
+	second.publish("a", "two")
+	if msg := <-agent.messages; msg != "a:two" {
+		t.Error("Expected to receive a:two. Got:", msg)
+	}
+}
+
+// plainConn hides the redis.ConnWithTimeout methods of its Conn
+type plainConn struct {
+	redis.Conn
+}
+
+func TestRedisBroker_ConnWithoutTimeout(t *testing.T) {
+	conn := newFakeConn()
+	broker, err := synk.NewRedisBroker(synk.Config{
+		RedisDial: func() (redis.Conn, error) { return plainConn{conn}, nil },
+		Logger:    &testLogger{events: make(chan logEvent, 10)},
+	})
+	if err != nil {
+		t.Fatal("NewRedisBroker failed:", err)
+	}
+	defer broker.Close()
+
+	// The broker must receive without a timeout, instead of failing and
+	// reconnecting.
+	agent := &recordingAgent{messages: make(chan string, 1), resyncs: make(chan []string, 1)}
+	broker.Update(agent, []string{"a"}, nil)
+	conn.publish("a", "one")
+	select {
+	case msg := <-agent.messages:
+		if msg != "a:one" {
+			t.Error("Expected to receive a:one. Got:", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the broker to receive the message")
+	}
+	if !broker.Connected() {
+		t.Error("Expected the broker to stay connected")
+	}
+}
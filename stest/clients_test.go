@@ -0,0 +1,134 @@
+package stest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CharlesHolbrow/synk"
+	"github.com/gorilla/websocket"
+)
+
+// announcement is a message sent to clients by SendToClient and Broadcast
+type announcement struct {
+	Method string `json:"method"`
+	Text   string `json:"text"`
+}
+
+func TestMemoryNode_Disconnect(t *testing.T) {
+	lc := newLifecycleClient()
+	node, server := newMemoryServer(t, withClients(lc.constructor))
+	disconnected := make(chan int, 1)
+	node.SetDisconnectHandler(func(client synk.Client, code int, reason string) {
+		disconnected <- code
+	})
+	conn := dial(t, server)
+	id := <-lc.ids
+
+	subscribe(conn, []string{"synk:disconnect"}, []string{})
+	var msg testMsg
+	if readJSON(t, conn, &msg); msg.Method != "subscriptionError" {
+		t.Error("Expected reserved subscription keys to be rejected. Got:", msg)
+	}
+
+	if err := node.Disconnect(id, 4001, "kicked"); err != nil {
+		t.Fatal("Disconnect failed:", err)
+	}
+	if err := readClose(conn); !websocket.IsCloseError(err, 4001) {
+		t.Error("Expected the client to be closed with code 4001. Got:", err)
+	}
+	select {
+	case code := <-disconnected:
+		if code != 4001 {
+			t.Error("Expected the DisconnectHandler to get code 4001. Got:", code)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the DisconnectHandler to be called")
+	}
+
+	if err := node.Disconnect(id, 999, ""); err == nil {
+		t.Error("Expected an invalid close code to be rejected")
+	}
+}
+
+func TestMemoryNode_LifecycleCallbacks(t *testing.T) {
+	lc := newLifecycleClient()
+	node, server := newMemoryServer(t, withClients(lc.constructor))
+
+	conn := dial(t, server)
+	id := <-lc.ids
+	subscribe(conn, []string{"a", "b"}, []string{})
+	subscribe(conn, []string{"b"}, []string{"a", "b", "c"})
+	select {
+	case subKeys := <-lc.unsubscribed:
+		if len(subKeys) != 1 || subKeys[0] != "a" {
+			t.Error("Expected OnUnsubscribe for a. Got:", subKeys)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected OnUnsubscribe to be called")
+	}
+
+	node.Disconnect(id, websocket.ClosePolicyViolation, "cheating")
+	select {
+	case reason := <-lc.disconnected:
+		if reason != "cheating" {
+			t.Error("Expected OnDisconnect with the close reason. Got:", reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected OnDisconnect to be called")
+	}
+	select {
+	case subKeys := <-lc.unsubscribed:
+		t.Error("Expected no OnUnsubscribe call on disconnect. Got:", subKeys)
+	default:
+	}
+}
+
+func TestMemoryNode_SendToClient(t *testing.T) {
+	lc := newLifecycleClient()
+	node, server := newMemoryServer(t, withClients(lc.constructor))
+	conn := dial(t, server)
+	id := <-lc.ids
+
+	online, err := node.SendToClient(id, announcement{Method: "whisper", Text: "hi"})
+	if err != nil || !online {
+		t.Fatal("Expected the client to be online. Got:", online, err)
+	}
+	var msg announcement
+	if readJSON(t, conn, &msg); msg.Method != "whisper" || msg.Text != "hi" {
+		t.Error("Expected the direct message. Got:", msg)
+	}
+
+	conn.Close()
+	<-lc.disconnected
+	waitFor(t, "the client to be offline", func() bool {
+		online, _ = node.SendToClient(id, []byte(`{"method":"whisper"}`))
+		return !online
+	})
+}
+
+func TestMemoryNode_Broadcast(t *testing.T) {
+	node, server := newMemoryServer(t)
+	conns := []*websocket.Conn{dial(t, server), dial(t, server)}
+	waitFor(t, "both clients to join the pool", func() bool {
+		return node.Metrics().Gauge("synk_clients", "").Value() == 2
+	})
+
+	expect := func(text string) {
+		for _, conn := range conns {
+			var msg announcement
+			if readJSON(t, conn, &msg); msg.Method != "announce" || msg.Text != text {
+				t.Errorf("Expected the %s announcement. Got: %v", text, msg)
+			}
+		}
+	}
+
+	if err := node.BroadcastLocal([]byte(`{"method":"announce","text":"local"}`)); err != nil {
+		t.Fatal("BroadcastLocal failed:", err)
+	}
+	expect("local")
+
+	if err := node.Broadcast(announcement{Method: "announce", Text: "cluster"}); err != nil {
+		t.Fatal("Broadcast failed:", err)
+	}
+	expect("cluster")
+}
@@ -0,0 +1,285 @@
+package stest
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CharlesHolbrow/synk"
+	"github.com/gorilla/websocket"
+)
+
+func TestMemoryNode_NamedClients(t *testing.T) {
+	node, server := newMemoryServer(t, withClients(func(c synk.Client) synk.CustomClient { return greeter("default") }))
+	node.RegisterNamedClientConstructor("spectator", func(c synk.Client) synk.CustomClient { return greeter("spectator") })
+	handler := server.Config.Handler.(*synk.Handler)
+	handler.Select = synk.SelectBySubprotocol("spectator")
+
+	conn := dialWith(t, &websocket.Dialer{Subprotocols: []string{"spectator"}}, wsURL(server))
+	if conn.Subprotocol() != "spectator" {
+		t.Error("Expected the spectator subprotocol to be selected. Got:", conn.Subprotocol())
+	}
+	if msg := readMsg(t, conn); msg.Method != "spectator" {
+		t.Error("Expected the spectator client. Got:", msg.Method)
+	}
+
+	conn2 := dial(t, server)
+	if msg := readMsg(t, conn2); msg.Method != "default" {
+		t.Error("Expected the default client. Got:", msg.Method)
+	}
+
+	handler.Select = synk.SelectByQuery("kind")
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL(server)+"?kind=editor", nil); err == nil || resp.StatusCode != http.StatusNotFound {
+		t.Error("Expected an unknown client name to be rejected with 404")
+	}
+}
+
+func TestMemoryNode_Authenticator(t *testing.T) {
+	node, server := newMemoryServer(t, withClients(func(c synk.Client) synk.CustomClient {
+		return greeter(c.Principal().(string))
+	}))
+	node.SetAuthenticator(synk.AuthenticatorFunc(func(r *http.Request) (interface{}, error) {
+		if token := r.URL.Query().Get("token"); token != "" {
+			return "user-" + token, nil
+		}
+		return nil, errors.New("missing token")
+	}))
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL(server), nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected an unauthenticated request to be rejected with 401")
+	}
+
+	conn := dialWith(t, websocket.DefaultDialer, wsURL(server)+"?token=7")
+	if msg := readMsg(t, conn); msg.Method != "user-7" {
+		t.Error("Expected the client to see its principal. Got:", msg.Method)
+	}
+}
+
+func TestHandler_AllowedOrigins(t *testing.T) {
+	_, server := newMemoryServer(t, withHandler(func(handler *synk.Handler) {
+		handler.Upgrade.AllowedOrigins = []string{"https://*.example.com"}
+		handler.Upgrade.RejectCrossSite = true
+	}))
+
+	for origin, allowed := range map[string]bool{
+		"":                          true,
+		server.URL:                  true,
+		"https://play.example.com":  true,
+		"https://PLAY.Example.com":  true,
+		"https://example.com":       false,
+		"https://play.example.com.": false,
+		"https://evil.com":          false,
+	} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL(server), header)
+		if allowed && err != nil {
+			t.Errorf("Expected origin %q to be allowed. Got: %s", origin, err)
+		} else if !allowed && (err == nil || resp.StatusCode != http.StatusForbidden) {
+			t.Errorf("Expected origin %q to be rejected with 403", origin)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+// recordingConn keeps a copy of everything read from the network, so tests
+// can inspect the websocket frames.
+type recordingConn struct {
+	net.Conn
+	mutex sync.Mutex
+	read  bytes.Buffer
+}
+
+func (rc *recordingConn) Read(b []byte) (int, error) {
+	n, err := rc.Conn.Read(b)
+	rc.mutex.Lock()
+	rc.read.Write(b[:n])
+	rc.mutex.Unlock()
+	return n, err
+}
+
+// frame is a websocket frame sent by the server
+type frame struct {
+	compressed bool
+	payload    []byte
+}
+
+// frames parses the frames that followed the handshake response
+func (rc *recordingConn) frames() []frame {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	data := rc.read.Bytes()
+	data = data[bytes.Index(data, []byte("\r\n\r\n"))+4:]
+
+	var frames []frame
+	for len(data) >= 2 {
+		compressed := data[0]&0x40 != 0
+		length, header := int(data[1]&0x7f), 2
+		switch length {
+		case 126:
+			length, header = int(binary.BigEndian.Uint16(data[2:])), 4
+		case 127:
+			length, header = int(binary.BigEndian.Uint64(data[2:])), 10
+		}
+		frames = append(frames, frame{compressed, data[header : header+length]})
+		data = data[header+length:]
+	}
+	return frames
+}
+
+// writer writes each of its messages to the websocket when it connects
+type writer []string
+
+func (w writer) OnConnect(client synk.Client) {
+	for _, msg := range w {
+		client.WriteToWebSocket([]byte(msg))
+	}
+}
+func (w writer) OnMessage(client synk.Client, method string, data []byte)       {}
+func (w writer) OnSubscribe(client synk.Client, keys []string, o []synk.Object) {}
+
+// deflate compresses msg like a websocket frame compressed at level
+func deflate(msg string, level int) []byte {
+	var b bytes.Buffer
+	w, _ := flate.NewWriter(&b, level)
+	w.Write([]byte(msg))
+	w.Flush()
+	return bytes.TrimSuffix(b.Bytes(), []byte{0, 0, 0xff, 0xff})
+}
+
+func TestHandler_Compression(t *testing.T) {
+	var numbers strings.Builder
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&numbers, "%d,", i*i%97)
+	}
+	short := `{"method":"short"}`
+	long := `{"method":"` + numbers.String() + `"}`
+	if bytes.Equal(deflate(long, 9), deflate(long, flate.DefaultCompression)) {
+		t.Fatal("Expected the compression level to change the compressed message")
+	}
+
+	_, server := newMemoryServer(t,
+		withClients(func(c synk.Client) synk.CustomClient { return writer{short, long} }),
+		withHandler(func(handler *synk.Handler) {
+			handler.Upgrade.EnableCompression = true
+			handler.Upgrade.CompressionLevel = 9
+			handler.Upgrade.CompressionThreshold = 256
+		}))
+
+	var rc *recordingConn
+	dialer := &websocket.Dialer{
+		EnableCompression: true,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			rc = &recordingConn{Conn: conn}
+			return rc, err
+		},
+	}
+	conn, resp, err := dialer.Dial(wsURL(server), nil)
+	if err != nil {
+		t.Fatal("Failed to dial:", err)
+	}
+	defer conn.Close()
+	if !strings.Contains(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate") {
+		t.Error("Expected permessage-deflate to be negotiated")
+	}
+	if msg := readMsg(t, conn); msg.Method != "short" {
+		t.Error("Expected to read the short message. Got:", msg.Method)
+	}
+	if msg := readMsg(t, conn); msg.Method != numbers.String() {
+		t.Error("Expected to read the long message. Got:", msg.Method)
+	}
+
+	frames := rc.frames()
+	if len(frames) != 2 {
+		t.Fatal("Expected two frames. Got:", len(frames))
+	}
+	if frames[0].compressed || string(frames[0].payload) != short {
+		t.Error("Expected the message below the threshold to be uncompressed")
+	}
+	if !frames[1].compressed || !bytes.Equal(frames[1].payload, deflate(long, 9)) {
+		t.Error("Expected the message above the threshold to be compressed at level 9")
+	}
+}
+
+func TestHandler_MessagePack(t *testing.T) {
+	node, server := newMemoryServer(t, withHandler(func(handler *synk.Handler) {
+		handler.Codecs = map[string]synk.Codec{synk.MessagePackSubprotocol: synk.MessagePack}
+	}))
+
+	mutator := node.CreateMutator()
+	defer mutator.Close()
+	h := &Human{}
+	h.SetMapID("m")
+	h.SetX(-300)
+	mutator.Create(h)
+
+	conn := dialWith(t, &websocket.Dialer{Subprotocols: []string{synk.MessagePackSubprotocol}}, wsURL(server))
+	if conn.Subprotocol() != synk.MessagePackSubprotocol {
+		t.Error("Expected the MessagePack subprotocol. Got:", conn.Subprotocol())
+	}
+
+	sub, _ := json.Marshal(synk.UpdateSubscriptionMessage{
+		Method: "updateSubscription",
+		Add:    []string{"m:0|0"},
+	})
+	packed, err := synk.MessagePack.Encode(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteMessage(websocket.BinaryMessage, packed)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	kind, data, err := conn.ReadMessage()
+	if err != nil || kind != websocket.BinaryMessage {
+		t.Fatal("Expected a binary message. Got:", kind, err)
+	}
+	data, err = synk.MessagePack.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg struct {
+		testMsg
+		State struct{ X int }
+	}
+	json.Unmarshal(data, &msg)
+	if msg.Method != "add" || msg.ID != h.TagGetID() || msg.State.X != -300 {
+		t.Error("Expected add message. Got:", string(data))
+	}
+}
+
+func TestHandler_SelectByPath(t *testing.T) {
+	for _, prefix := range []string{"/ws", "/ws/"} {
+		selector := synk.SelectByPath(prefix)
+		for path, name := range map[string]string{
+			"/ws":            "",
+			"/ws/":           "",
+			"/ws/spectator":  "spectator",
+			"/ws/spectator/": "spectator",
+			"/wsx":           "",
+			"/":              "",
+		} {
+			if got := selector(httptest.NewRequest("GET", path, nil)); got != name {
+				t.Errorf("SelectByPath(%q) selected %q for %s. Expected %q", prefix, got, path, name)
+			}
+		}
+	}
+	if got := synk.SelectByPath("")(httptest.NewRequest("GET", "/", nil)); got != "" {
+		t.Errorf("Expected the root path to select the default constructor. Got: %q", got)
+	}
+}
@@ -0,0 +1,116 @@
+package stest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CharlesHolbrow/synk"
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestNode_HealthRedis(t *testing.T) {
+	var mutex sync.Mutex
+	var pingErr error
+	var timeouts []time.Duration
+	cfg := synk.Config{
+		RedisDial: func() (redis.Conn, error) {
+			conn := newFakeConn()
+			conn.ping = func(timeout time.Duration) error {
+				mutex.Lock()
+				defer mutex.Unlock()
+				timeouts = append(timeouts, timeout)
+				return pingErr
+			}
+			return conn, nil
+		},
+		RedisMaxIdle: 1,
+		Logger:       &testLogger{events: make(chan logEvent, 10)},
+	}
+	node, err := synk.NewNodeWithConfig(cfg)
+	if err != nil {
+		t.Fatal("NewNodeWithConfig failed:", err)
+	}
+
+	if status := node.Health(); !status.Ready || status.Checks["redis"] != "ok" || status.Checks["broker"] != "ok" {
+		t.Error("Expected a ready node. Got:", status)
+	}
+	mutex.Lock()
+	if len(timeouts) != 1 || timeouts[0] <= 0 {
+		t.Error("Expected one PING with a timeout. Got:", timeouts)
+	}
+	pingErr = errors.New("LOADING")
+	mutex.Unlock()
+
+	if status := node.Health(); status.Ready || status.Checks["redis"] != "LOADING" {
+		t.Error("Expected the redis check to fail. Got:", status)
+	}
+
+	node.Shutdown(context.Background())
+	if status := node.Health(); status.Ready || !status.ShuttingDown || len(status.Checks) != 0 {
+		t.Error("Expected no checks once the node is shut down. Got:", status)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(timeouts) != 2 {
+		t.Error("Expected no PING after Shutdown. Got:", len(timeouts))
+	}
+}
+
+func TestNode_HealthConnWithoutTimeout(t *testing.T) {
+	node, err := synk.NewNodeWithConfig(synk.Config{
+		RedisDial: func() (redis.Conn, error) {
+			conn := newFakeConn()
+			conn.ping = func(time.Duration) error { return nil }
+			return plainConn{conn}, nil
+		},
+		RedisMaxIdle: 1,
+		Logger:       &testLogger{events: make(chan logEvent, 10)},
+	})
+	if err != nil {
+		t.Fatal("NewNodeWithConfig failed:", err)
+	}
+	defer node.Shutdown(context.Background())
+
+	if status := node.Health(); !status.Ready || status.Checks["redis"] != "ok" {
+		t.Error("Expected a ready node. Got:", status)
+	}
+}
+
+// The mongo check needs a mongodb server. It is skipped if there is none.
+func TestNode_HealthMongo(t *testing.T) {
+	cfg := synk.ConfigFromEnv()
+	cfg.MongoDialTimeout = time.Second
+	cfg.RedisDial = func() (redis.Conn, error) {
+		conn := newFakeConn()
+		conn.ping = func(time.Duration) error { return nil }
+		return conn, nil
+	}
+	cfg.Logger = &testLogger{events: make(chan logEvent, 10)}
+	node, err := synk.NewNodeWithConfig(cfg)
+	if errors.Is(err, synk.ErrBackendUnavailable) {
+		t.Skip("mongodb is not available:", err)
+	} else if err != nil {
+		t.Fatal("NewNodeWithConfig failed:", err)
+	}
+
+	if status := node.Health(); !status.Ready || status.Checks["mongo"] != "ok" {
+		t.Error("Expected a ready node. Got:", status)
+	}
+
+	// Shutdown closes the mongo session. Health must not use it afterwards.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			node.Health()
+		}
+	}()
+	node.Shutdown(context.Background())
+	<-done
+	if status := node.Health(); status.Ready || len(status.Checks) != 0 {
+		t.Error("Expected no checks once the node is shut down. Got:", status)
+	}
+}
@@ -0,0 +1,179 @@
+package stest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CharlesHolbrow/synk"
+	"github.com/gorilla/websocket"
+)
+
+func TestMemoryNode_ClientLimits(t *testing.T) {
+	node, server := newMemoryServer(t)
+	node.SetClientLimits(synk.ClientLimits{
+		MaxMessageSize:   1024,
+		MaxSubscriptions: 2,
+		MethodRates:      map[string]synk.Rate{"ping": {PerSecond: 0.001, Burst: 1}},
+		Action:           synk.LimitReplyError,
+	})
+	conn := dial(t, server)
+
+	subscribe(conn, []string{"a", "b", "c"}, []string{})
+	if msg := readProtocolError(t, conn); msg.Code != "tooManySubscriptions" || len(msg.SKeys) != 1 || msg.SKeys[0] != "c" {
+		t.Error("Expected subscription key c to be refused. Got:", msg)
+	}
+
+	send(conn, `{"method":"ping"}`)
+	send(conn, `{"method":"ping"}`)
+	if msg := readProtocolError(t, conn); msg.Code != "rateLimited" || msg.For != "ping" {
+		t.Error("Expected the second ping to be rate limited. Got:", msg)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, make([]byte, 2048))
+	if err := readClose(conn); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Error("Expected the client to be closed with CloseMessageTooBig. Got:", err)
+	}
+}
+
+// recorder reports the method of each message, and the comma separated keys
+// of each subscription, that reach the custom client.
+type recorder struct {
+	methods    chan string
+	subscribed chan string
+}
+
+func newRecorder() *recorder {
+	return &recorder{methods: make(chan string, 10), subscribed: make(chan string, 10)}
+}
+
+func (r *recorder) OnConnect(client synk.Client) {}
+func (r *recorder) OnMessage(client synk.Client, method string, data []byte) {
+	r.methods <- method
+}
+func (r *recorder) OnSubscribe(client synk.Client, keys []string, o []synk.Object) {
+	r.subscribed <- strings.Join(keys, ",")
+}
+
+// next returns the next string on c, or fails the test after two seconds
+func next(t *testing.T, c chan string) string {
+	select {
+	case s := <-c:
+		return s
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the custom client")
+	}
+	return ""
+}
+
+func TestMemoryNode_RateLimit(t *testing.T) {
+	r := newRecorder()
+	node, server := newMemoryServer(t, withClients(func(c synk.Client) synk.CustomClient { return r }))
+	node.SetClientLimits(synk.ClientLimits{
+		Rate:        synk.Rate{PerSecond: 0.001, Burst: 2},
+		MethodRates: map[string]synk.Rate{"ping": {PerSecond: 0.001, Burst: 1}},
+		Action:      synk.LimitReplyError,
+	})
+	conn := dial(t, server)
+
+	// The second ping is refused by its method bucket, so it must not use up
+	// the client's Rate.
+	send(conn, `{"method":"ping"}`)
+	send(conn, `{"method":"ping"}`)
+	send(conn, `{"method":"move"}`)
+	send(conn, `{"method":"move"}`)
+	if msg := readProtocolError(t, conn); msg.Code != "rateLimited" || msg.For != "ping" {
+		t.Error("Expected the second ping to be rate limited. Got:", msg)
+	}
+	if msg := readProtocolError(t, conn); msg.Code != "rateLimited" || msg.For != "move" {
+		t.Error("Expected the second move to exceed the client's Rate. Got:", msg)
+	}
+	if method := next(t, r.methods); method != "ping" {
+		t.Error("Expected the first ping. Got:", method)
+	}
+	if method := next(t, r.methods); method != "move" {
+		t.Error("Expected the first move. Got:", method)
+	}
+}
+
+func TestMemoryNode_LimitDrop(t *testing.T) {
+	r := newRecorder()
+	node, server := newMemoryServer(t, withClients(func(c synk.Client) synk.CustomClient { return r }))
+	node.SetClientLimits(synk.ClientLimits{
+		MethodRates: map[string]synk.Rate{"ping": {PerSecond: 0.001, Burst: 1}},
+		Action:      synk.LimitDrop,
+	})
+	conn := dial(t, server)
+
+	send(conn, `{"method":"ping"}`)
+	send(conn, `{"method":"ping"}`)
+	send(conn, `{"method":"move"}`)
+	if method := next(t, r.methods); method != "ping" {
+		t.Error("Expected the first ping. Got:", method)
+	}
+	if method := next(t, r.methods); method != "move" {
+		t.Error("Expected the second ping to be dropped. Got:", method)
+	}
+
+	// Dropped messages are not answered
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, data, err := conn.ReadMessage(); err == nil {
+		t.Error("Expected no reply to a dropped message. Got:", string(data))
+	}
+}
+
+func TestMemoryNode_LimitDisconnect(t *testing.T) {
+	node, server := newMemoryServer(t)
+	node.SetClientLimits(synk.ClientLimits{
+		Rate:   synk.Rate{PerSecond: 0.001, Burst: 1},
+		Action: synk.LimitDisconnect,
+	})
+	conn := dial(t, server)
+
+	send(conn, `{"method":"ping"}`)
+	send(conn, `{"method":"ping"}`)
+	err := readClose(conn)
+	if closeErr, ok := err.(*websocket.CloseError); !ok || closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != "limit exceeded" {
+		t.Error("Expected a ClosePolicyViolation close frame. Got:", err)
+	}
+}
+
+func TestMemoryNode_MaxMessageSize(t *testing.T) {
+	r := newRecorder()
+	node, server := newMemoryServer(t, withClients(func(c synk.Client) synk.CustomClient { return r }))
+	node.SetClientLimits(synk.ClientLimits{MaxMessageSize: 64, Action: synk.LimitDrop})
+	conn := dial(t, server)
+
+	fits := `{"method":"` + strings.Repeat("a", 64-len(`{"method":""}`)) + `"}`
+	send(conn, fits)
+	if method := next(t, r.methods); len(method) != 64-len(`{"method":""}`) {
+		t.Error("Expected a message of MaxMessageSize to be handled. Got:", method)
+	}
+
+	// Even with LimitDrop, a larger message disconnects the client
+	send(conn, `{"method":"`+strings.Repeat("a", 64)+`"}`)
+	if err := readClose(conn); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Error("Expected the client to be closed with CloseMessageTooBig. Got:", err)
+	}
+}
+
+func TestMemoryNode_MaxSubscriptions(t *testing.T) {
+	r := newRecorder()
+	node, server := newMemoryServer(t, withClients(func(c synk.Client) synk.CustomClient { return r }))
+	node.SetClientLimits(synk.ClientLimits{MaxSubscriptions: 2, Action: synk.LimitReplyError})
+	conn := dial(t, server)
+
+	subscribe(conn, []string{"a", "b", "c"}, nil)
+	if keys := next(t, r.subscribed); keys != "a,b" {
+		t.Error("Expected to subscribe up to the limit. Got:", keys)
+	}
+	if msg := readProtocolError(t, conn); msg.Code != "tooManySubscriptions" || strings.Join(msg.SKeys, ",") != "c" {
+		t.Error("Expected subscription key c to be refused. Got:", msg)
+	}
+
+	// Keys removed by the same message make room for new keys
+	subscribe(conn, []string{"c"}, []string{"a"})
+	if keys := next(t, r.subscribed); keys != "c" {
+		t.Error("Expected c to replace a. Got:", keys)
+	}
+}
@@ -0,0 +1,277 @@
+package stest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CharlesHolbrow/synk"
+	"github.com/gorilla/websocket"
+)
+
+func TestMemorySynk_Move(t *testing.T) {
+	broker := synk.NewMemoryBroker()
+	defer broker.Close()
+	mem := synk.NewMemorySynk(broker)
+
+	h := &Human{}
+	h.SetMapID("m")
+	if err := mem.Create(h); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.Create(h); !errors.Is(err, synk.ErrConflict) {
+		t.Error("Creating the same object twice should return ErrConflict. Got:", err)
+	}
+
+	h.SetCX(1)
+	if err := mem.Modify(h); err != nil {
+		t.Fatal(err)
+	}
+
+	if objs, _ := mem.Load([]string{"m:0|0"}); len(objs) != 0 {
+		t.Error("Expected the object to leave m:0|0. Found:", objs)
+	}
+	objs, _ := mem.Load([]string{"m:1|0"})
+	if len(objs) != 1 || objs[0].TagGetID() != h.TagGetID() {
+		t.Fatal("Expected to load the object in m:1|0. Found:", objs)
+	}
+
+	// Loaded objects are copies
+	objs[0].(*Human).SetCX(2)
+	objs[0].Resolve()
+	if objs, _ = mem.Load([]string{"m:1|0"}); len(objs) != 1 {
+		t.Error("Mutating a loaded object should not change the store")
+	}
+
+	if err := mem.Delete(h); err != nil {
+		t.Fatal(err)
+	}
+	if objs, _ = mem.Load([]string{"m:1|0"}); len(objs) != 0 {
+		t.Error("Expected the object to be deleted. Found:", objs)
+	}
+	if err := mem.Delete(h); !errors.Is(err, synk.ErrNotFound) {
+		t.Error("Deleting a missing object should return ErrNotFound. Got:", err)
+	}
+}
+
+func TestMemoryNode_Handler(t *testing.T) {
+	node, server := newMemoryServer(t)
+	mutator := node.CreateMutator()
+	defer mutator.Close()
+
+	h := &Human{}
+	h.SetMapID("m")
+	if err := mutator.Create(h); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := dial(t, server)
+	subscribe(conn, []string{"m:0|0", "m:1|0"}, nil)
+
+	// The initial state arrives after the subscription takes effect
+	if msg := readMsg(t, conn); msg.Method != "add" || msg.ID != h.TagGetID() {
+		t.Fatal("Expected add message for the initial state. Got:", msg)
+	}
+
+	h.SetX(5)
+	mutator.Modify(h)
+	if msg := readMsg(t, conn); msg.Method != "mod" || msg.SKey != "m:0|0" {
+		t.Fatal("Expected mod message. Got:", msg)
+	}
+
+	// The client is subscribed to both chunks, so the "from" add message for
+	// the move must not reach it.
+	h.SetCX(1)
+	mutator.Modify(h)
+	if msg := readMsg(t, conn); msg.Method != "mod" || msg.NSKey != "m:1|0" {
+		t.Fatal("Expected mod message with nsKey. Got:", msg)
+	}
+
+	mutator.Delete(h)
+	if msg := readMsg(t, conn); msg.Method != "rem" || msg.SKey != "m:1|0" {
+		t.Fatal("Expected rem message. Got:", msg)
+	}
+}
+
+func TestMemoryNode_MoveIntoSubscription(t *testing.T) {
+	node, server := newMemoryServer(t)
+	mutator := node.CreateMutator()
+	defer mutator.Close()
+
+	h := &Human{}
+	h.SetMapID("m")
+	mutator.Create(h)
+
+	o := &Human{}
+	o.SetMapID("m")
+	o.SetCX(1)
+	mutator.Create(o)
+
+	conn := dial(t, server)
+	subscribe(conn, []string{"m:1|0"}, nil)
+	if msg := readMsg(t, conn); msg.Method != "add" || msg.ID != o.TagGetID() {
+		t.Fatal("Expected add message for the initial state. Got:", msg)
+	}
+
+	// h moves from an unsubscribed chunk into a subscribed chunk
+	h.SetCX(1)
+	mutator.Modify(h)
+	if msg := readMsg(t, conn); msg.Method != "add" || msg.PSKey != "m:0|0" {
+		t.Fatal("Expected add message with psKey. Got:", msg)
+	}
+}
+
+func TestMemoryNode_Shutdown(t *testing.T) {
+	node, server := newMemoryServer(t)
+	conn := dial(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := node.Shutdown(ctx); err != nil {
+		t.Fatal("Shutdown failed:", err)
+	}
+
+	if err := readClose(conn); !websocket.IsCloseError(err, websocket.CloseServiceRestart) {
+		t.Error("Expected a CloseServiceRestart close frame. Got:", err)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL(server), nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Error("Expected new connections to be rejected after Shutdown")
+	}
+
+	if err := node.Shutdown(ctx); err == nil {
+		t.Error("Expected a second call to Shutdown to fail")
+	}
+}
+
+// blocker blocks in OnConnect until release is closed
+type blocker struct {
+	testClient
+	connected chan struct{}
+	release   chan struct{}
+}
+
+func (b *blocker) OnConnect(client synk.Client) {
+	close(b.connected)
+	<-b.release
+}
+
+func TestMemoryNode_ShutdownTimeout(t *testing.T) {
+	b := &blocker{connected: make(chan struct{}), release: make(chan struct{})}
+	node, server := newMemoryServer(t, withClients(func(c synk.Client) synk.CustomClient { return b }))
+	dial(t, server)
+	<-b.connected
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := node.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("Expected Shutdown to return DeadlineExceeded. Got:", err)
+	}
+
+	// The client finishes connecting after Shutdown returned. Its Handler
+	// must still be able to add it to, and remove it from, the stopped pool.
+	close(b.release)
+	waitFor(t, "the client to be removed", func() bool {
+		recorder := httptest.NewRecorder()
+		node.Metrics().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		return strings.Contains(recorder.Body.String(), "synk_clients 0\n")
+	})
+}
+
+type logEvent struct {
+	msg     string
+	keyvals []interface{}
+}
+
+// testLogger records Info events
+type testLogger struct {
+	events chan logEvent
+}
+
+func (tl *testLogger) Debug(msg string, keyvals ...interface{}) {}
+func (tl *testLogger) Error(msg string, keyvals ...interface{}) {}
+func (tl *testLogger) Info(msg string, keyvals ...interface{}) {
+	tl.events <- logEvent{msg, keyvals}
+}
+
+func TestMemoryNode_Logger(t *testing.T) {
+	node, server := newMemoryServer(t)
+	logger := &testLogger{events: make(chan logEvent, 10)}
+	node.SetLogger(logger)
+	dial(t, server)
+
+	select {
+	case event := <-logger.events:
+		if len(event.keyvals) < 2 || event.keyvals[0] != "client" {
+			t.Error("Expected client log events to include the client ID. Got:", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the node's Logger to receive an event")
+	}
+}
+
+func TestMemoryNode_Metrics(t *testing.T) {
+	node, server := newMemoryServer(t)
+	conn := dial(t, server)
+	subscribe(conn, []string{"m:0|0", "m:1|0"}, nil)
+
+	expected := []string{
+		"# TYPE synk_clients gauge",
+		"synk_clients 1",
+		"synk_subscriptions 2",
+		"synk_load_seconds_count 1",
+		`synk_load_seconds_bucket{le="+Inf"} 1`,
+	}
+
+	// The subscription is handled asynchronously, so poll the metrics
+	var body string
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		recorder := httptest.NewRecorder()
+		node.Metrics().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		body = recorder.Body.String()
+		if strings.Contains(body, "synk_load_seconds_count 1") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected metrics to contain %q. Got:\n%s", line, body)
+		}
+	}
+}
+
+func TestMemoryNode_Health(t *testing.T) {
+	node, server := newMemoryServer(t)
+	dial(t, server)
+
+	check := func(code int) synk.HealthStatus {
+		var status synk.HealthStatus
+		recorder := httptest.NewRecorder()
+		node.HealthHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/health", nil))
+		if recorder.Code != code {
+			t.Errorf("Expected health status code %d. Got %d", code, recorder.Code)
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+			t.Fatal("Failed to parse health JSON:", err)
+		}
+		return status
+	}
+
+	if status := check(http.StatusOK); !status.Ready || status.Checks["broker"] != "ok" {
+		t.Error("Expected a ready node with a healthy broker. Got:", status)
+	}
+
+	node.Shutdown(context.Background())
+
+	if status := check(http.StatusServiceUnavailable); status.Ready || !status.ShuttingDown {
+		t.Error("Expected the node to not be ready after Shutdown. Got:", status)
+	}
+}
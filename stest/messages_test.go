@@ -0,0 +1,87 @@
+package stest
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/CharlesHolbrow/synk"
+)
+
+func TestMemoryNode_RPC(t *testing.T) {
+	node, server := newMemoryServer(t)
+	node.RegisterRPC("add", func(ctx context.Context, client synk.Client, params json.RawMessage) (interface{}, error) {
+		var args []int
+		if err := json.Unmarshal(params, &args); err != nil || len(args) != 2 {
+			return nil, &synk.RPCError{Code: "badParams", Message: "expected two numbers"}
+		}
+		return args[0] + args[1], nil
+	})
+	node.RegisterRPC("sleep", func(ctx context.Context, client synk.Client, params json.RawMessage) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	conn := dial(t, server)
+
+	type reply struct {
+		Method string          `json:"method"`
+		RID    json.RawMessage `json:"rid"`
+		Result json.RawMessage `json:"result"`
+		Error  *synk.RPCError  `json:"error"`
+	}
+	call := func(request string) reply {
+		var r reply
+		send(conn, request)
+		readJSON(t, conn, &r)
+		return r
+	}
+
+	if r := call(`{"method":"add","rid":1,"params":[2,3]}`); string(r.RID) != "1" || string(r.Result) != "5" || r.Error != nil {
+		t.Error("Expected result 5 for rid 1. Got:", r)
+	}
+	if r := call(`{"method":"add","rid":"b","params":"x"}`); string(r.RID) != `"b"` || r.Error == nil || r.Error.Code != "badParams" {
+		t.Error("Expected a badParams error for rid b. Got:", r)
+	}
+	if r := call(`{"method":"sleep","rid":3,"timeout":20}`); r.Error == nil || r.Error.Code != "timeout" {
+		t.Error("Expected a timeout error. Got:", r)
+	}
+	if r := call(`{"method":"add","rid":4,"params":[1,1],"timeout":"soon"}`); string(r.RID) != "4" || r.Error == nil || r.Error.Code != "decodeFailed" {
+		t.Error("Expected a decodeFailed error for a malformed request. Got:", r)
+	}
+}
+
+type moveRequest struct {
+	X  int    `json:"x" synk:"required"`
+	To string `json:"to"`
+}
+
+func TestMemoryNode_MessageHandlers(t *testing.T) {
+	node, server := newMemoryServer(t)
+	moves := make(chan moveRequest, 1)
+	node.RegisterMessageHandler("move", func(client synk.Client, req *moveRequest) {
+		moves <- *req
+	})
+	conn := dial(t, server)
+
+	expectError := func(request, code string) {
+		send(conn, request)
+		if msg := readProtocolError(t, conn); msg.Code != code {
+			t.Errorf("Expected a %s protocol error for %s. Got: %v", code, request, msg)
+		}
+	}
+
+	send(conn, `{"method":"move","x":3,"to":"a"}`)
+	select {
+	case req := <-moves:
+		if req.X != 3 || req.To != "a" {
+			t.Error("Expected the request to be decoded. Got:", req)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the move handler to be called")
+	}
+
+	expectError(`{"method":"move","to":"a"}`, "missingField")
+	expectError(`{"method":"move","x":"three"}`, "decodeFailed")
+	expectError(`{"method":"jump"}`, "unknownMethod")
+}
@@ -0,0 +1,81 @@
+package stest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/CharlesHolbrow/synk"
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestRedisSynk_NotFound(t *testing.T) {
+	conn := newFakeConn()
+	conn.eval = func(args ...interface{}) (interface{}, error) {
+		// The scripts reply "NO" when the object does not exist
+		return []byte("NO"), nil
+	}
+	cfg := synk.Config{
+		RedisDial:    func() (redis.Conn, error) { return conn, nil },
+		RedisMaxIdle: 1,
+	}
+	rs := &synk.RedisSynk{Pool: cfg.DialRedisPool(), Constructor: creator}
+
+	h := &Human{}
+	h.SetMapID("m")
+	if err := rs.Modify(h); !errors.Is(err, synk.ErrNotFound) {
+		t.Error("Modifying a missing object should return ErrNotFound. Got:", err)
+	}
+	if err := rs.Delete(h); !errors.Is(err, synk.ErrNotFound) {
+		t.Error("Deleting a missing object should return ErrNotFound. Got:", err)
+	}
+}
+
+// The scripts need a redis server. The test is skipped if there is none.
+func TestRedisSynk_Move(t *testing.T) {
+	pool := synk.ConfigFromEnv().DialRedisPool()
+	defer pool.Close()
+	conn := pool.Get()
+	_, err := conn.Do("PING")
+	conn.Close()
+	if err != nil {
+		t.Skip("redis is not available:", err)
+	}
+	rs := &synk.RedisSynk{Pool: pool, Constructor: creator}
+
+	h := &Human{}
+	h.SetMapID("m")
+	if err := rs.Create(h); err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Delete(h)
+
+	h.SetCX(1)
+	if err := rs.Modify(h); err != nil {
+		t.Fatal(err)
+	}
+	objs, _ := rs.Load([]string{h.GetSubKey()})
+	found := false
+	for _, obj := range objs {
+		found = found || obj.TagGetID() == h.TagGetID()
+	}
+	if !found {
+		t.Error("Expected to load the object in", h.GetSubKey())
+	}
+
+	if err := rs.Delete(h); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.Delete(h); !errors.Is(err, synk.ErrNotFound) {
+		t.Error("Deleting a missing object should return ErrNotFound. Got:", err)
+	}
+	h.SetX(3)
+	if err := rs.Modify(h); !errors.Is(err, synk.ErrNotFound) {
+		t.Error("Modifying a deleted object should return ErrNotFound. Got:", err)
+	}
+	objs, _ = rs.Load([]string{h.GetSubKey()})
+	for _, obj := range objs {
+		if obj.TagGetID() == h.TagGetID() {
+			t.Error("Modify must not recreate a deleted object")
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package stest
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CharlesHolbrow/synk"
+	"github.com/gorilla/websocket"
+)
+
+type testClient struct{}
+
+func (tc *testClient) OnConnect(client synk.Client)                                   {}
+func (tc *testClient) OnMessage(client synk.Client, method string, data []byte)       {}
+func (tc *testClient) OnSubscribe(client synk.Client, keys []string, o []synk.Object) {}
+
+func newTestClient(client synk.Client) synk.CustomClient {
+	return &testClient{}
+}
+
+// greeter writes its name to the websocket when it connects
+type greeter string
+
+func (g greeter) OnConnect(client synk.Client) {
+	client.WriteToWebSocket([]byte(`{"method":"` + string(g) + `"}`))
+}
+func (g greeter) OnMessage(client synk.Client, method string, data []byte)       {}
+func (g greeter) OnSubscribe(client synk.Client, keys []string, o []synk.Object) {}
+
+// lifecycleClient reports the ID of each client that connects, and the
+// optional OnUnsubscribe and OnDisconnect callbacks.
+type lifecycleClient struct {
+	testClient
+	ids          chan string
+	unsubscribed chan []string
+	disconnected chan string
+}
+
+func newLifecycleClient() *lifecycleClient {
+	return &lifecycleClient{
+		ids:          make(chan string, 1),
+		unsubscribed: make(chan []string, 1),
+		disconnected: make(chan string, 1),
+	}
+}
+
+func (lc *lifecycleClient) OnConnect(client synk.Client) {
+	lc.ids <- client.ID()
+}
+
+func (lc *lifecycleClient) OnUnsubscribe(client synk.Client, subKeys []string) {
+	lc.unsubscribed <- subKeys
+}
+
+func (lc *lifecycleClient) OnDisconnect(client synk.Client, reason string) {
+	lc.disconnected <- reason
+}
+
+// constructor creates every client with the same lifecycleClient
+func (lc *lifecycleClient) constructor(client synk.Client) synk.CustomClient {
+	return lc
+}
+
+// A serverOption changes how newMemoryServer sets up its node and Handler
+type serverOption func(*serverConfig)
+
+type serverConfig struct {
+	constructor synk.ClientConstructor
+	handler     func(*synk.Handler)
+}
+
+// withClients creates clients with constructor instead of newTestClient
+func withClients(constructor synk.ClientConstructor) serverOption {
+	return func(cfg *serverConfig) { cfg.constructor = constructor }
+}
+
+// withHandler lets configure change the Handler before it is served
+func withHandler(configure func(*synk.Handler)) serverOption {
+	return func(cfg *serverConfig) { cfg.handler = configure }
+}
+
+// newMemoryServer creates a memory backed node, and serves it with httptest.
+func newMemoryServer(t *testing.T, options ...serverOption) (*synk.Node, *httptest.Server) {
+	cfg := serverConfig{constructor: newTestClient}
+	for _, option := range options {
+		option(&cfg)
+	}
+
+	node := synk.NewMemoryNode()
+	node.RegisterContainerConstructor(creator)
+	node.RegisterClientConstructor(cfg.constructor)
+	handler := synk.NewHandler(node)
+	if cfg.handler != nil {
+		cfg.handler(handler)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return node, server
+}
+
+// wsURL returns the websocket URL of server
+func wsURL(server *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func dial(t *testing.T, server *httptest.Server) *websocket.Conn {
+	return dialWith(t, &websocket.Dialer{}, wsURL(server))
+}
+
+func dialWith(t *testing.T, dialer *websocket.Dialer, url string) *websocket.Conn {
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal("Failed to dial test server:", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// subscribe sends an updateSubscription message
+func subscribe(conn *websocket.Conn, add []string, remove []string) {
+	msg, _ := json.Marshal(synk.UpdateSubscriptionMessage{
+		Method: "updateSubscription",
+		Add:    add,
+		Remove: remove,
+	})
+	conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+func send(conn *websocket.Conn, msg string) {
+	conn.WriteMessage(websocket.TextMessage, []byte(msg))
+}
+
+type testMsg struct {
+	Method string `json:"method"`
+	ID     string `json:"id"`
+	SKey   string `json:"sKey"`
+	NSKey  string `json:"nsKey"`
+	PSKey  string `json:"psKey"`
+}
+
+func readMsg(t *testing.T, conn *websocket.Conn) testMsg {
+	var msg testMsg
+	readJSON(t, conn, &msg)
+	return msg
+}
+
+func readJSON(t *testing.T, conn *websocket.Conn, v interface{}) {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := conn.ReadJSON(v); err != nil {
+		t.Fatal("Failed to read from websocket:", err)
+	}
+}
+
+// protocolError is a protocolError message from the node
+type protocolError struct {
+	Method string   `json:"method"`
+	For    string   `json:"for"`
+	Code   string   `json:"code"`
+	SKeys  []string `json:"sKeys"`
+}
+
+// readProtocolError skips messages until it reads a protocolError
+func readProtocolError(t *testing.T, conn *websocket.Conn) protocolError {
+	var msg protocolError
+	for msg.Method != "protocolError" {
+		readJSON(t, conn, &msg)
+	}
+	return msg
+}
+
+// readClose reads until the websocket fails, and returns the error. Once the
+// server closes the connection, it is a *websocket.CloseError.
+func readClose(conn *websocket.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return err
+		}
+	}
+}
+
+// waitFor polls condition until it is true, or fails the test after two
+// seconds.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	for deadline := time.Now().Add(2 * time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
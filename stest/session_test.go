@@ -0,0 +1,172 @@
+package stest
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CharlesHolbrow/synk"
+	"github.com/gorilla/websocket"
+)
+
+type sessionMsg struct {
+	Method  string `json:"method"`
+	Token   string `json:"token"`
+	Resumed bool   `json:"resumed"`
+}
+
+func readSession(t *testing.T, conn *websocket.Conn) sessionMsg {
+	var msg sessionMsg
+	if readJSON(t, conn, &msg); msg.Method != "session" {
+		t.Fatal("Expected a session message. Got:", msg)
+	}
+	return msg
+}
+
+func TestMemoryNode_SessionResume(t *testing.T) {
+	node, server := newMemoryServer(t)
+	node.EnableSessionResume(time.Minute, 100)
+
+	mutator := node.CreateMutator()
+	defer mutator.Close()
+	h := &Human{}
+	h.SetMapID("m")
+	mutator.Create(h)
+
+	conn := dial(t, server)
+	session := readSession(t, conn)
+	subscribe(conn, []string{"m:0|0"}, nil)
+	if msg := readMsg(t, conn); msg.Method != "add" {
+		t.Fatal("Expected add message. Got:", msg)
+	}
+	h.SetX(1)
+	mutator.Modify(h)
+	readMsg(t, conn)
+
+	// The browser drops without a close frame, and misses two messages
+	conn.UnderlyingConn().Close()
+	time.Sleep(50 * time.Millisecond)
+	h.SetX(2)
+	mutator.Modify(h)
+	mutator.Delete(h)
+
+	conn2 := dialWith(t, websocket.DefaultDialer, wsURL(server)+"?resume="+session.Token+"&received=2")
+	if resumed := readSession(t, conn2); !resumed.Resumed || resumed.Token != session.Token {
+		t.Fatal("Expected the session to be resumed. Got:", resumed)
+	}
+	if msg := readMsg(t, conn2); msg.Method != "mod" {
+		t.Error("Expected the missed mod message. Got:", msg)
+	}
+	if msg := readMsg(t, conn2); msg.Method != "rem" {
+		t.Error("Expected the missed rem message. Got:", msg)
+	}
+
+	// The subscription was kept
+	h2 := &Human{}
+	h2.SetMapID("m")
+	mutator.Create(h2)
+	if msg := readMsg(t, conn2); msg.Method != "add" || msg.ID != h2.TagGetID() {
+		t.Error("Expected add message on the resumed subscription. Got:", msg)
+	}
+
+	// A token can only be used by one client at a time
+	conn3 := dialWith(t, websocket.DefaultDialer, wsURL(server)+"?resume="+session.Token+"&received=5")
+	if msg := readSession(t, conn3); msg.Resumed || msg.Token == session.Token {
+		t.Error("Expected a new session. Got:", msg)
+	}
+}
+
+func TestMemoryNode_SessionChurnUnderLoad(t *testing.T) {
+	node, server := newMemoryServer(t)
+	node.EnableSessionResume(time.Minute, 100)
+	churn(t, node, server)
+}
+
+// bannableClient authorizes any key that is not banned, and reports the keys
+// passed to OnSubscribe.
+type bannableClient struct {
+	testClient
+	mutex      sync.Mutex
+	banned     map[string]bool
+	subscribed chan []string
+}
+
+func (bc *bannableClient) ban(subKey string) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	bc.banned[subKey] = true
+}
+
+func (bc *bannableClient) AuthorizeSubscription(client synk.Client, subKey string) (string, error) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	if bc.banned[subKey] {
+		return "", errors.New("banned")
+	}
+	return subKey, nil
+}
+
+func (bc *bannableClient) OnSubscribe(client synk.Client, subKeys []string, objs []synk.Object) {
+	bc.subscribed <- subKeys
+}
+
+func TestMemoryNode_SessionResumeAuthorization(t *testing.T) {
+	bc := &bannableClient{banned: make(map[string]bool), subscribed: make(chan []string, 1)}
+	node, server := newMemoryServer(t, withClients(func(c synk.Client) synk.CustomClient { return bc }))
+	node.EnableSessionResume(time.Minute, 100)
+	node.SetAuthenticator(synk.AuthenticatorFunc(func(r *http.Request) (interface{}, error) {
+		return r.URL.Query().Get("user"), nil
+	}))
+	resumeURL := func(user, token string) string {
+		return wsURL(server) + "?user=" + user + "&resume=" + token + "&received=0"
+	}
+
+	mutator := node.CreateMutator()
+	defer mutator.Close()
+	kept, banned := &Human{}, &Human{}
+	kept.SetMapID("m")
+	banned.SetMapID("m")
+	banned.SetCX(1)
+
+	conn := dialWith(t, websocket.DefaultDialer, wsURL(server)+"?user=alice")
+	session := readSession(t, conn)
+	subscribe(conn, []string{"m:0|0", "m:1|0"}, nil)
+	<-bc.subscribed
+	conn.UnderlyingConn().Close()
+	waitFor(t, "the client to disconnect", func() bool {
+		return node.Metrics().Gauge("synk_clients", "").Value() == 0
+	})
+
+	// Another principal cannot use the token
+	mallory := dialWith(t, websocket.DefaultDialer, resumeURL("mallory", session.Token))
+	if msg := readSession(t, mallory); msg.Resumed {
+		t.Fatal("Expected a different principal to get a new session")
+	}
+	mallory.Close()
+
+	bc.ban("m:1|0")
+	conn2 := dialWith(t, websocket.DefaultDialer, resumeURL("alice", session.Token))
+	if msg := readSession(t, conn2); !msg.Resumed {
+		t.Fatal("Expected the owner to resume the session")
+	}
+	var rejected protocolError
+	if readJSON(t, conn2, &rejected); rejected.Method != "subscriptionError" || len(rejected.SKeys) != 1 || rejected.SKeys[0] != "m:1|0" {
+		t.Error("Expected the banned key to be rejected. Got:", rejected)
+	}
+	select {
+	case subKeys := <-bc.subscribed:
+		if len(subKeys) != 1 || subKeys[0] != "m:0|0" {
+			t.Error("Expected OnSubscribe for the restored key. Got:", subKeys)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected OnSubscribe for the restored key")
+	}
+
+	mutator.Create(banned)
+	mutator.Create(kept)
+	if msg := readMsg(t, conn2); msg.ID != kept.TagGetID() {
+		t.Error("Expected no messages for the banned key. Got:", msg)
+	}
+}
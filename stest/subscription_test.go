@@ -0,0 +1,131 @@
+package stest
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CharlesHolbrow/synk"
+)
+
+// chunkAuthorizer only allows subscriptions to chunks in map "m". Keys in map
+// "alias" are rewritten to the same chunk in "m".
+type chunkAuthorizer struct{ testClient }
+
+func (ca *chunkAuthorizer) AuthorizeSubscription(client synk.Client, subKey string) (string, error) {
+	switch {
+	case strings.HasPrefix(subKey, "m:"):
+		return subKey, nil
+	case strings.HasPrefix(subKey, "alias:"):
+		return "m:" + strings.TrimPrefix(subKey, "alias:"), nil
+	}
+	return "", errors.New("forbidden")
+}
+
+func TestMemoryNode_SubscriptionAuthorizer(t *testing.T) {
+	node, server := newMemoryServer(t, withClients(func(c synk.Client) synk.CustomClient { return &chunkAuthorizer{} }))
+
+	mutator := node.CreateMutator()
+	defer mutator.Close()
+	secret := &Human{}
+	secret.SetMapID("secret")
+	mutator.Create(secret)
+	h := &Human{}
+	h.SetMapID("m")
+	mutator.Create(h)
+
+	conn := dial(t, server)
+	subscribe(conn, []string{"secret:0|0", "alias:0|0"}, nil)
+
+	var rejected struct {
+		Method string   `json:"method"`
+		SKeys  []string `json:"sKeys"`
+	}
+	readJSON(t, conn, &rejected)
+	if rejected.Method != "subscriptionError" || len(rejected.SKeys) != 1 || rejected.SKeys[0] != "secret:0|0" {
+		t.Error("Expected a subscriptionError for secret:0|0. Got:", rejected)
+	}
+
+	// The alias was rewritten, so we receive the object in m:0|0, but not
+	// the secret object.
+	if msg := readMsg(t, conn); msg.Method != "add" || msg.ID != h.TagGetID() || msg.SKey != "m:0|0" {
+		t.Error("Expected add message for the rewritten key. Got:", msg)
+	}
+	secret.SetX(1)
+	mutator.Modify(secret)
+	h.SetX(1)
+	mutator.Modify(h)
+	if msg := readMsg(t, conn); msg.ID != h.TagGetID() {
+		t.Error("Expected no messages from the rejected key. Got:", msg)
+	}
+}
+
+// createHumans creates count Humans in chunk m:0|0
+func createHumans(node *synk.Node, count int) {
+	mutator := node.CreateMutator()
+	defer mutator.Close()
+	for i := 0; i < count; i++ {
+		h := &Human{}
+		h.SetMapID("m")
+		mutator.Create(h)
+	}
+}
+
+func TestMemoryNode_LoadBatches(t *testing.T) {
+	// Measure an add message, without batches
+	node, server := newMemoryServer(t)
+	createHumans(node, 1)
+	conn := dial(t, server)
+	subscribe(conn, []string{"m:0|0"}, nil)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, add, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal("Failed to read from websocket:", err)
+	}
+
+	// Three add messages fit in a batch, but not with the rest of the
+	// addBatch message around them.
+	size := 3*len(add) + 2 + 10
+	node, server = newMemoryServer(t)
+	node.SetLoadBatchSize(size)
+	createHumans(node, 20)
+
+	conn = dial(t, server)
+	subscribe(conn, []string{"m:0|0", "m:1|0"}, nil)
+
+	var batch struct {
+		Method string    `json:"method"`
+		SKey   string    `json:"sKey"`
+		Objs   []testMsg `json:"objs"`
+	}
+	objects, batches := 0, 0
+	for batch.Method != "subscribed" {
+		batch.Method = ""
+		batch.Objs = nil
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal("Failed to read from websocket:", err)
+		}
+		if len(data) > size {
+			t.Errorf("Expected batches of at most %d bytes. Got a message of length %d", size, len(data))
+		}
+		json.Unmarshal(data, &batch)
+		if batch.Method == "addBatch" {
+			batches++
+			objects += len(batch.Objs)
+		}
+		if batch.SKey != "m:0|0" {
+			t.Fatal("Expected messages for m:0|0. Got:", string(data))
+		}
+	}
+	if objects != 20 || batches < 2 {
+		t.Errorf("Expected 20 objects in several batches. Got %d in %d", objects, batches)
+	}
+
+	// The empty key is also reported
+	if msg := readMsg(t, conn); msg.Method != "subscribed" || msg.SKey != "m:1|0" {
+		t.Error("Expected subscribed message for m:1|0. Got:", msg)
+	}
+}